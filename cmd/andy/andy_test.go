@@ -99,11 +99,14 @@ func TestStrings(t *testing.T) {
 func TestTilde(t *testing.T) {
 	dir, _ := os.UserHomeDir()
 	s := dir + "/foo/bar\n" +
-		dir + "\n" +
+		"~\n" +
 		"/root\n" +
 		"~ \n" +
 		"~\n" +
-		" ~\n"
+		" ~\n" +
+		"no match\n" +
+		"match\n" +
+		"call no match\n"
 	runAndCapture(t, "tilde", s, "")
 }
 
@@ -149,3 +152,19 @@ func TestLoop(t *testing.T) {
 		"foo\nbar\nfoo\nbar\nfoo\nbar\n"
 	runAndCapture(t, "loop", s, "")
 }
+
+func TestCd(t *testing.T) {
+	runAndCapture(t, "cd", "foo\nfoo\nfoo\nfoo\n", "")
+}
+
+func TestExitStatus(t *testing.T) {
+	// Scripts exit with the status of the command that failed
+	c := exec.Command("../andy", "signal.an")
+	out, _ := c.Output()
+	if string(out) != "before\n" {
+		t.Fatalf("Stdout returned unexpected ‘%s’", out)
+	}
+	if code := c.ProcessState.ExitCode(); code != 128+15 {
+		t.Fatalf("Expected exit code 143 but got %d", code)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"git.sr.ht/~mango/andy/pkg/andy"
+	"git.sr.ht/~mango/andy/pkg/diff"
+	"git.sr.ht/~mango/opts/v2"
+)
+
+// runFmt implements ‘andy fmt’, which formats the given scripts in place.  With
+// no files it formats standard input to standard output.  With -d it prints
+// diffs instead of writing the files, and fails if any file isn’t formatted.
+func runFmt(args []string) int {
+	flags, rest, err := opts.Get(args, "d")
+	if err != nil {
+		warn(err)
+		fmt.Fprintln(os.Stderr, "Usage: andy fmt [-d] [file ...]")
+		return 1
+	}
+	dflag := len(flags) > 0
+
+	if len(rest) == 0 {
+		bytes, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			warn(err)
+			return 1
+		}
+		return fmtFile("<stdin>", string(bytes), dflag, func(s string) error {
+			_, err := io.WriteString(os.Stdout, s)
+			return err
+		})
+	}
+
+	rv := 0
+	for _, f := range rest {
+		bytes, err := os.ReadFile(f)
+		if err != nil {
+			warn(err)
+			rv = 1
+			continue
+		}
+		rv = max(rv, fmtFile(f, string(bytes), dflag, func(s string) error {
+			return writeFile(f, s)
+		}))
+	}
+	return rv
+}
+
+func fmtFile(name, src string, dflag bool, write func(string) error) int {
+	out, err := andy.Format(name, src)
+	switch {
+	case err != nil:
+		warn(err)
+		return 1
+	case dflag:
+		d := diff.Unified(name+".orig", name, src, out)
+		if d == "" {
+			return 0
+		}
+		io.WriteString(os.Stdout, d)
+		return 1
+	case out == src && name != "<stdin>":
+		return 0
+	}
+
+	if err := write(out); err != nil {
+		warn(err)
+		return 1
+	}
+	return 0
+}
+
+// writeFile replaces the contents of the file name with s, keeping its
+// permissions
+func writeFile(name, s string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, []byte(s), info.Mode().Perm())
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"git.sr.ht/~mango/andy/pkg/andy"
+)
+
+// runLint implements ‘andy lint’, which reports likely bugs in the given
+// scripts, or in standard input if no files are given
+func runLint(args []string) int {
+	if len(args) == 0 {
+		bytes, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			warn(err)
+			return 1
+		}
+		return lintFile("<stdin>", string(bytes))
+	}
+
+	rv := 0
+	for _, f := range args {
+		bytes, err := os.ReadFile(f)
+		if err != nil {
+			warn(err)
+			rv = 1
+			continue
+		}
+		rv = max(rv, lintFile(f, string(bytes)))
+	}
+	return rv
+}
+
+func lintFile(name, src string) int {
+	diags := andy.Lint(name, src)
+	for _, d := range diags {
+		fmt.Println(d)
+	}
+	if len(diags) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -6,57 +6,146 @@ import (
 	"fmt"
 	"io"
 	"os"
-)
+	"os/signal"
 
-var globalVm vm
+	"git.sr.ht/~mango/andy/pkg/andy"
+	"git.sr.ht/~mango/andy/pkg/lsp"
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fmt":
+			os.Exit(runFmt(os.Args[1:]))
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		case "lsp":
+			if err := lsp.Serve(os.Stdin, os.Stdout); err != nil {
+				die(err)
+			}
+			os.Exit(0)
+		}
+	}
+
+	sh := andy.New()
+	sh.Exit = os.Exit
 	if len(os.Args) == 1 {
-		runRepl()
+		runRepl(sh)
 	} else {
-		globalVm.file = true
-		runFile(os.Args[1])
+		sh.SetVar("args", os.Args[1:]...)
+		runFile(sh, os.Args[1])
+		exit(sh, 0)
 	}
 }
 
-func runRepl() {
-	runFile(".andyrc")
+// An input is a line read by the REPL
+type input struct {
+	line string
+	err  error
+}
+
+func runRepl(sh *andy.Interpreter) {
+	runFile(sh, ".andyrc")
 
 	r := bufio.NewReader(os.Stdin)
-	globalVm.interactive = true
+	sh.Interactive = true
+
+	// Ctrl-C interrupts whatever is running, or cancels the line being
+	// typed if nothing is.  The kernel discards the text of the line for us.
+	sigs := make(chan os.Signal, 1)
+	atPrompt := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		for range sigs {
+			select {
+			case atPrompt <- struct{}{}:
+			default:
+				sh.Interrupt()
+			}
+		}
+	}()
+
+	// Standard input is only read while at the prompt, as otherwise we
+	// would steal the input of the commands we run
+	lines := make(chan input)
+	var reading bool
 
 	for {
-		fmt.Fprintf(os.Stderr, "[%s] > ", globalVariableMap["status"][0])
-		line, err := r.ReadString('\n')
+		status, _ := sh.Var("status")
+		fmt.Fprintf(os.Stderr, "[%s] > ", status[0])
+		if !reading {
+			reading = true
+			go func() {
+				line, err := r.ReadString('\n')
+				lines <- input{line, err}
+			}()
+		}
+
+		var in input
+		select {
+		case in = <-lines:
+			reading = false
+		case <-atPrompt:
+			fmt.Fprintln(os.Stderr)
+			continue
+		case n := <-sh.Signals():
+			fmt.Fprintln(os.Stderr)
+			sh.HandleSignal(n)
+			continue
+		}
 
 		switch {
-		case errors.Is(err, io.EOF):
+		case errors.Is(in.err, io.EOF):
 			fmt.Fprintln(os.Stderr, "^D")
-			os.Exit(0)
-		case err != nil:
-			warn(err)
+			exit(sh, 0)
+		case in.err != nil:
+			warn(in.err)
 		}
 
-		l := newLexer(line)
-		p := newParser(l.out)
-		go l.run()
-		globalVm.run(p.run())
+		prog, err := andy.Parse(in.line)
+		if err != nil {
+			warn(err)
+			continue
+		}
+		err = sh.Run(prog)
+		if e, ok := err.(interface{ Status() string }); ok && e.Status() == "sigint" {
+			fmt.Fprintln(os.Stderr)
+		}
 	}
 }
 
-func runFile(f string) {
+func runFile(sh *andy.Interpreter, f string) {
 	bytes, err := os.ReadFile(f)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
 		return
 	case err != nil:
-		die(err)
+		warn(err)
+		exit(sh, 1)
 	}
 
-	l := newLexer(string(bytes))
-	p := newParser(l.out)
-	go l.run()
-	globalVm.run(p.run())
+	prog, err := andy.ParseFile(f, string(bytes))
+	if err != nil {
+		warn(err)
+		exit(sh, 1)
+	}
+	if err := sh.Run(prog); err != nil {
+		// Commands killed by signals exit with 128 plus the signal number
+		code := 1
+		if e, ok := err.(interface{ ExitCode() uint8 }); ok && e.ExitCode() != 0 {
+			code = int(e.ExitCode())
+		}
+		exit(sh, code)
+	}
+}
+
+// exit runs the ‘sigexit’ function of sh and exits with code, or with 1 if
+// the function fails
+func exit(sh *andy.Interpreter, code int) {
+	if err := sh.RunExitHook(); err != nil && code == 0 {
+		code = 1
+	}
+	os.Exit(code)
 }
 
 func warn(e error) {
@@ -0,0 +1,407 @@
+// Package andy implements the Andy shell language.  The Interpreter type can
+// be used to run Andy code from within other Go programs.
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.sr.ht/~mango/andy/pkg/stack"
+)
+
+// An Interpreter holds the state of a running shell: its variables,
+// functions, builtins, environment, and working directory.  Interpreters are
+// independent of each other and of the process they run in, with the exception
+// of signal handlers which are process-wide.
+type Interpreter struct {
+	// The standard streams used when running top-level code
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+
+	// If Interactive is true, Run will continue executing code after a
+	// command fails instead of stopping
+	Interactive bool
+
+	// If Exit is not nil, it is called with the exit code after the exit hook
+	// runs when the shell exits through the ‘exit’ builtin or a fatal
+	// signal.  Whether or not it returns, the code being run stops and Run
+	// returns an error reporting the exit code.
+	Exit func(code int)
+
+	// If MaxSubstOutput is positive, process substitutions that output more
+	// than this many bytes fail instead of using up all of the memory.  It
+	// defaults to 64 MiB.
+	MaxSubstOutput int64
+
+	funcs    map[string]function
+	sigs     map[string]chan os.Signal // The signals handled by functions
+	ignored  map[string]chan os.Signal // The signals ignored by ‘signal -i’
+	pending  chan string               // Signals waiting to be handled
+	vars     map[string][]string
+	maps     map[string]*mapVar
+	env      map[string]string
+	builtins map[string]*Builtin
+	wd       workDir
+	exit     *exitState
+	async    asyncState
+	hash     cmdHash
+
+	interrupted atomic.Bool
+	exited      atomic.Bool
+	procs       procSet
+	writers     writerSet
+}
+
+// A procSet is the set of external commands currently running
+type procSet struct {
+	m   map[*os.Process]struct{}
+	mtx sync.Mutex
+}
+
+func (ps *procSet) add(p *os.Process) {
+	ps.mtx.Lock()
+	ps.m[p] = struct{}{}
+	ps.mtx.Unlock()
+}
+
+func (ps *procSet) remove(p *os.Process) {
+	ps.mtx.Lock()
+	delete(ps.m, p)
+	ps.mtx.Unlock()
+}
+
+// A writerSet holds the locked versions of the writers given to the
+// interpreter, so that every context writing to the same writer shares the
+// same lock.  Writers are never forgotten, but programs rarely use more than
+// a few.
+type writerSet struct {
+	m   map[io.Writer]*lockedWriter
+	mtx sync.Mutex
+}
+
+// A lockedWriter serializes writes to a writer that pipeline stages, async
+// commands, and the foreground may all be writing to at once
+type lockedWriter struct {
+	w   io.Writer
+	mtx sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mtx.Lock()
+	defer lw.mtx.Unlock()
+	return lw.w.Write(p)
+}
+
+// locked returns w made safe for concurrent use.  Files already are, so
+// they’re returned as-is.
+func (ws *writerSet) locked(w io.Writer) io.Writer {
+	switch w.(type) {
+	case nil, *os.File, *lockedWriter:
+		return w
+	}
+	if !reflect.TypeOf(w).Comparable() {
+		return &lockedWriter{w: w}
+	}
+
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	lw, ok := ws.m[w]
+	if !ok {
+		lw = &lockedWriter{w: w}
+		ws.m[w] = lw
+	}
+	return lw
+}
+
+// A Program is a parsed Andy script
+type Program struct {
+	tls   astProgram
+	stmts []*chunk // One per top-level statement
+}
+
+// New returns a new interpreter with the standard builtins, using the
+// environment and working directory of the current process
+func New() *Interpreter {
+	sh := &Interpreter{
+		Stdin:          os.Stdin,
+		Stdout:         os.Stdout,
+		Stderr:         os.Stderr,
+		MaxSubstOutput: 64 << 20,
+		funcs:          make(map[string]function, 64),
+		sigs:           make(map[string]chan os.Signal),
+		ignored:        make(map[string]chan os.Signal),
+		pending:        make(chan string, 16),
+		builtins:       maps.Clone(builtins),
+		env:            make(map[string]string, 64),
+		maps:           make(map[string]*mapVar),
+		vars: map[string][]string{
+			"_":      {}, // Other shells export this
+			"pid":    {strconv.Itoa(os.Getpid())},
+			"ppid":   {strconv.Itoa(os.Getppid())},
+			"status": {"0"},
+		},
+	}
+
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			sh.env[k] = v
+		}
+	}
+
+	// If this fails, the empty string makes us fall back to the working
+	// directory of the process
+	cwd, _ := os.Getwd()
+	sh.wd = workDir{cwd, stack.New[string](64)}
+	sh.exit = new(exitState)
+	sh.async.wgs = make(map[uint64]*sync.WaitGroup, 32)
+	sh.hash.m = make(map[string]string, 64)
+	sh.procs.m = make(map[*os.Process]struct{})
+	sh.writers.m = make(map[io.Writer]*lockedWriter)
+	return sh
+}
+
+// Parse parses the Andy source code in src
+func Parse(src string) (Program, error) {
+	return ParseFile("", src)
+}
+
+// ParseFile is like Parse, but records name as the file the source code came
+// from for use in error messages and source locations
+func ParseFile(name, src string) (Program, error) {
+	prog, _, err := parse(name, src)
+	if err != nil {
+		return Program{}, err
+	}
+
+	stmts := make([]*chunk, len(prog))
+	for i, tl := range prog {
+		stmts[i] = compile([]astTopLevel{tl})
+	}
+	return Program{prog, stmts}, nil
+}
+
+func parse(name, src string) (astProgram, []comment, error) {
+	l := newLexer(src)
+	l.file = name
+	p := newParser(&l)
+	prog, err := p.run()
+	if err != nil {
+		return nil, nil, err
+	}
+	return prog, l.comments, nil
+}
+
+// Run executes prog.  Unless the interpreter is interactive, execution stops
+// at the first failing command, and it always stops once the shell exits.  The
+// ‘sigexit’ function is only run when the shell exits; see RunExitHook.  Shell errors are reported on the standard
+// error of the interpreter.  The returned error, if not nil, has an
+// ExitCode() uint8 method reporting the exit code of the failed command and a
+// Status() string method reporting its status as stored in $status.
+func (sh *Interpreter) Run(prog Program) error {
+	var err error
+	sh.interrupted.Store(false)
+	sh.exit.code.Store(0)
+	for _, c := range prog.stmts {
+		res := run(c, sh.newContext())
+		if res := sh.exit.result(); res != nil {
+			sh.vars["status"] = []string{res.Status()}
+			err = res
+			break
+		}
+		if sh.interrupted.Swap(false) {
+			sh.vars["status"] = []string{errInterrupted.Status()}
+			err = errInterrupted
+			break
+		}
+		sh.vars["status"] = []string{res.Status()}
+		if cmdFailed(res) {
+			if _, ok := res.(shellError); ok {
+				sh.warn(res)
+			}
+			if !sh.Interactive {
+				err = res
+				break
+			}
+		}
+	}
+	return err
+}
+
+// RunExitHook runs the ‘sigexit’ function if it is defined.  Programs using
+// the interpreter should call it on every path that exits the program.  The
+// function only ever runs once, so it is safe to call more than once.
+func (sh *Interpreter) RunExitHook() error {
+	f, ok := sh.funcs["sigexit"]
+	if !ok || sh.exited.Swap(true) {
+		return nil
+	}
+	ctx := sh.newContext()
+	ctx.masked = true
+	ctx.scope = map[string][]string{"_": {}}
+	ctx.maps = map[string]*mapVar{}
+	if res := run(f.code, ctx); cmdFailed(res) {
+		return res
+	}
+	return nil
+}
+
+// Signals returns the channel on which the names of received signals wait to
+// be handled by their functions.  Handlers run between the commands of the
+// code being run, so programs that block between calls to Run, such as a REPL
+// waiting for input, should receive from it and pass each name on to
+// HandleSignal.  Fatal signals without a function of their own exit the shell
+// as soon as they arrive.
+func (sh *Interpreter) Signals() <-chan string {
+	return sh.pending
+}
+
+// HandleSignal runs the function handling the signal n, as if the signal had
+// been received while running top-level code.  The returned error is like
+// that of Run.
+func (sh *Interpreter) HandleSignal(n string) error {
+	if res := sh.runHandler(n, sh.newContext()); cmdFailed(res) {
+		if _, ok := res.(shellError); ok {
+			sh.warn(res)
+		}
+		return res
+	}
+	return nil
+}
+
+// Interrupt stops the code being run by the interpreter as if the user had
+// pressed Ctrl-C.  Running external commands are sent SIGINT, and Andy code
+// stops at the start of the next command it would run.  The current call to
+// Run returns an error with the status ‘sigint’.
+func (sh *Interpreter) Interrupt() {
+	sh.interrupted.Store(true)
+	sh.procs.mtx.Lock()
+	defer sh.procs.mtx.Unlock()
+	for p := range sh.procs.m {
+		p.Signal(os.Interrupt)
+	}
+}
+
+// RunString parses and executes the Andy source code in src
+func (sh *Interpreter) RunString(src string) error {
+	prog, err := Parse(src)
+	if err != nil {
+		return err
+	}
+	return sh.Run(prog)
+}
+
+// RunFile parses and executes the Andy script at the given path, relative to
+// the working directory of the interpreter
+func (sh *Interpreter) RunFile(name string) error {
+	bytes, err := os.ReadFile(sh.newContext().resolve(name))
+	if err != nil {
+		return err
+	}
+	prog, err := ParseFile(name, string(bytes))
+	if err != nil {
+		return err
+	}
+	return sh.Run(prog)
+}
+
+// Var returns the value of the global variable name.  The value of a map is
+// its sorted keys.
+func (sh *Interpreter) Var(name string) ([]string, bool) {
+	if xs, ok := sh.vars[name]; ok {
+		return xs, true
+	}
+	if mv, ok := sh.maps[name]; ok {
+		return mv.keys(), true
+	}
+	return nil, false
+}
+
+// SetVar sets the global variable name to vals
+func (sh *Interpreter) SetVar(name string, vals ...string) error {
+	if err := checkVarName(name); err != nil {
+		return err
+	}
+	sh.vars[name] = vals
+	delete(sh.maps, name)
+	return nil
+}
+
+// UnsetVar removes the global variable name
+func (sh *Interpreter) UnsetVar(name string) {
+	delete(sh.vars, name)
+	delete(sh.maps, name)
+}
+
+// LookupEnv returns the value of the environment variable key
+func (sh *Interpreter) LookupEnv(key string) (string, bool) {
+	v, ok := sh.env[key]
+	return v, ok
+}
+
+// Setenv sets the environment variable key to value
+func (sh *Interpreter) Setenv(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\x00") {
+		return fmt.Errorf("invalid environment variable name ‘%s’", key)
+	}
+	if strings.IndexByte(value, 0) != -1 {
+		return errors.New("environment variables cannot contain NUL bytes")
+	}
+	sh.env[key] = value
+	if key == "PATH" {
+		sh.hash.clear()
+	}
+	return nil
+}
+
+// Unsetenv removes the environment variable key
+func (sh *Interpreter) Unsetenv(key string) {
+	delete(sh.env, key)
+	if key == "PATH" {
+		sh.hash.clear()
+	}
+}
+
+// Environ returns the environment of the interpreter in the form ‘key=value’
+func (sh *Interpreter) Environ() []string {
+	xs := make([]string, 0, len(sh.env))
+	for k, v := range sh.env {
+		xs = append(xs, k+"="+v)
+	}
+	slices.Sort(xs)
+	return xs
+}
+
+// Dir returns the working directory of the interpreter
+func (sh *Interpreter) Dir() string {
+	return sh.wd.cwd
+}
+
+// Chdir changes the working directory of the interpreter to dir
+func (sh *Interpreter) Chdir(dir string) error {
+	return chdir(sh.newContext(), dir)
+}
+
+func (sh *Interpreter) newContext() context {
+	return context{
+		in:   sh.Stdin,
+		out:  sh.writers.locked(sh.Stdout),
+		err:  sh.writers.locked(sh.Stderr),
+		wd:   &sh.wd,
+		exit: sh.exit,
+		sh:   sh,
+		fg:   true,
+	}
+}
+
+func (sh *Interpreter) warn(e error) {
+	fmt.Fprintf(sh.writers.locked(sh.Stderr), "andy: %s\n", e)
+}
@@ -0,0 +1,788 @@
+package andy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+func newTestInterpreter() (*Interpreter, *bytes.Buffer, *bytes.Buffer) {
+	var out, err bytes.Buffer
+	sh := New()
+	sh.Stdin = strings.NewReader("")
+	sh.Stdout = &out
+	sh.Stderr = &err
+	return sh, &out, &err
+}
+
+func TestRunString(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	if err := sh.RunString("echo foo | tr a-z A-Z; echo bar"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "FOO\nbar\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestRunStringFailure(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	err := sh.RunString("false; echo unreachable")
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 1 {
+		t.Fatalf("Expected an exit code of 1 but got ‘%s’", err)
+	}
+	if s := out.String(); s != "" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	if _, err := Parse("if true { echo foo"); err == nil {
+		t.Fatalf("Expected a parse error")
+	}
+
+	_, err := ParseFile("foo.an", "echo foo\necho 'bar")
+	if err == nil || err.Error() != "foo.an:2:6: unterminated string" {
+		t.Fatalf("Expected a lexing error but got ‘%v’", err)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	if err := sh.SetVar("xs", "foo", "bar"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := sh.SetVar("status", "1"); err == nil {
+		t.Fatalf("Expected setting ‘status’ to fail")
+	}
+	if err := sh.RunString("echo $#xs; set ys $xs baz"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "2\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+	ys, ok := sh.Var("ys")
+	if !ok || !slices.Equal(ys, []string{"foo", "bar", "baz"}) {
+		t.Fatalf("Variable ‘ys’ contained unexpected %q", ys)
+	}
+
+	// Setting a variable replaces a map of the same name
+	if err := sh.RunString("set 'm[k]' v"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	out.Reset()
+	sh.SetVar("m", "x")
+	sh.RunString("get 'm[k]'")
+	if s := out.String(); s == "v\n" {
+		t.Fatalf("Expected the map ‘m’ to be gone")
+	}
+}
+
+func TestInterpretersAreIndependent(t *testing.T) {
+	sh1, _, _ := newTestInterpreter()
+	sh2, out, _ := newTestInterpreter()
+	sh1.RunString("set x foo; func f { echo f }; set -e ANDY_TEST_VAR foo; cd /")
+	sh2.RunString("echo $x; type f; get -e ANDY_TEST_VAR; pwd")
+
+	cwd, _ := os.Getwd()
+	if s := out.String(); s != "\nunknown\n\n"+cwd+"\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+	if sh1.Dir() != "/" {
+		t.Fatalf("Expected working directory ‘/’ but got ‘%s’", sh1.Dir())
+	}
+}
+
+func TestConcurrentOutput(t *testing.T) {
+	// Run with -race to check that writes to the buffers are serialized
+	sh, out, errs := newTestInterpreter()
+	src := `
+sh -c 'echo a; echo b >&2' | sh -c 'cat; echo c >&2'
+func f { echo d; echo e }
+async f; echo f; wait`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	xs := strings.Fields(out.String() + errs.String())
+	slices.Sort(xs)
+	if !slices.Equal(xs, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Fatalf("Output contained unexpected %q", xs)
+	}
+}
+
+func TestCallEnv(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	src := `set -e ANDY_TEST_VAR foo
+call sh -c 'echo $ANDY_TEST_VAR'; call -c sh -c 'echo $ANDY_TEST_VAR'`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "foo\nfoo\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.RegisterBuiltin(&Builtin{
+		Name:  "greet",
+		Usage: []string{"greet [-s string] name ..."},
+		Flags: []Flag{{
+			Short: 's',
+			Long:  "suffix",
+			Arg:   opts.Required,
+			Value: "string",
+			Help:  "end greetings with ‘string’",
+		}},
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Run: func(c *Call) uint8 {
+			suf, ok := c.Flag('s')
+			if !ok {
+				suf = "!"
+			}
+			for _, a := range c.Args {
+				fmt.Fprintf(c.Stdout, "Hello %s%s\n", a, suf)
+			}
+			if err := c.SetVar("greeted", c.Args...); err != nil {
+				return c.Errorf("%s", err)
+			}
+			return 0
+		},
+	})
+
+	err := sh.RunString("greet foo bar | tac; greet -s . baz; echo $greeted\n" +
+		"func f { greet --suffix=? qux; echo $greeted }; f; echo $greeted\n" +
+		"greet --help\n" +
+		"greet || greet -x foo")
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	want := "Hello bar!\nHello foo!\nHello baz.\nbaz\n" +
+		"Hello qux?\nqux\nbaz\n" +
+		"Usage: greet [-s string] name ...\n\n" +
+		"Options:\n" +
+		"  -s, --suffix=string  end greetings with ‘string’\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+	want = "Usage: greet [-s string] name ...\n" +
+		"greet: unknown option ‘-x’\n" +
+		"Usage: greet [-s string] name ...\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected ‘%s’", s)
+	}
+}
+
+func TestExit(t *testing.T) {
+	sh, _, _ := newTestInterpreter()
+	var code int
+	sh.Exit = func(n int) { code = n }
+	err := sh.RunString("func f { exit 42 }; f; echo unreachable")
+	if code != 42 {
+		t.Fatalf("Expected exit code 42 but got %d", code)
+	}
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 42 {
+		t.Fatalf("Expected exit code 42 but got %v", err)
+	}
+
+	// Without Exit the shell stops all the same, but exiting a subshell
+	// doesn’t exit the shell
+	sh, out, _ := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+{ exit 3; echo unreachable } | cat; echo $status
+echo ` + "`" + `{exit 4; echo unreachable}; echo $status
+if true { exit 0 || echo unreachable }
+echo unreachable`
+	err = sh.RunString(src)
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 0 {
+		t.Fatalf("Expected exit code 0 but got %v", err)
+	}
+	if s := out.String(); s != "0\n4\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestExitHook(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	sh.Exit = func(int) {}
+	if err := sh.RunString("func sigexit { echo hook }; echo foo"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "foo\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+
+	// The hook only runs once, no matter how we exit
+	sh.RunString("exit 1")
+	if err := sh.RunExitHook(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "foo\nhook\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestExitSignal(t *testing.T) {
+	// Fatal signals exit straight away even while blocked reading input
+	sh, out, _ := newTestInterpreter()
+	r, w := io.Pipe()
+	sh.Stdin = r
+	codes := make(chan int, 1)
+	sh.Exit = func(n int) { codes <- n }
+	if err := sh.RunString("func sigexit { echo hook }"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer func() {
+		for _, n := range fatalSignals {
+			sh.unhandleSignal(n)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		sh.RunString("read line")
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case code := <-codes:
+		if code != 128+15 {
+			t.Fatalf("Expected exit code 143 but got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected SIGTERM to exit the shell")
+	}
+	w.Close()
+	<-done
+	if s := out.String(); s != "hook\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+func f x {
+	defer { echo first $x }
+	defer { echo second }
+	echo body
+}
+f a
+func g { defer { false }; true }
+g || echo failed
+func h { defer { echo cleanup }; false; echo unreachable }
+h || echo failed`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "body\nsecond\nfirst a\nfailed\ncleanup\nfailed\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+
+	if _, err := Parse("defer { true }"); err == nil ||
+		err.Error() != "1:1: ‘defer’ is only allowed in functions" {
+		t.Fatalf("Expected a top-level ‘defer’ to fail to parse but got %v", err)
+	}
+}
+
+func TestMaps(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+set m[a] 1 2
+set 'm[b c]' 3
+echo $m[a] / $m['b c'] / $#m / $m[nope] / $^m[a]
+for k in $m { echo $k = $m[$k] }
+set n m
+echo $($n)[a] $(m:-x)[a]
+func f { set m[z] 9; echo $m $m[z]; set -g m[g] 4 }
+f
+echo $m
+func g { set m[a]; set 'm[b c]'; set m[g]; echo $#m }
+g
+set xs[2] v
+set m[a]
+get 'm[b c]'
+set ys a b c; get ys[1]; get ys[1] ys[k]
+whatis m
+set l 1
+set l[k] v
+set -e m[a] x
+set m
+echo $#m`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "1 2 / 3 / 2 / / 1 2\na = 1 2\nb c = 3\n1 2 1 2\na b c z 9\na b c g\n0\n" +
+		"3\nb\nset 'm[b c]' 3\nset 'm[g]' 4\n0\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	want = "set: invalid index ‘2’ into list of length 0\n" +
+		"get: ‘k’ isn’t a valid index\n" +
+		"set: ‘k’ isn’t a valid index\n" +
+		"set: elements of maps can’t be environment variables\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestSetIndex(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+set xs a b c d e
+set xs[1] B; echo $xs
+set xs[1..3] x y z; echo $xs
+set xs[-1]; echo $xs
+set xs[0..0] first; echo $xs
+set xs[-2..] end; echo $xs
+set -a xs 1 2; set -p xs 0; echo $xs
+set -a xs[0] after; echo $xs
+set xs[9] q
+set xs[3..1] q
+func f { set xs[0] local; echo $xs; set -g -a xs g }
+f; echo $xs`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "a B c d e\na x y z d e\na x y z d\nfirst a x y z d\nfirst a x y end\n" +
+		"0 first a x y end 1 2\n0 after first a x y end 1 2\n" +
+		"local after first a x y end 1 2\n0 after first a x y end 1 2 g\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	want = "set: invalid index ‘9’ into list of length 9\n" +
+		"set: can’t assign to the reversed range ‘3..1’\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestListBuiltins(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+set xs c a b a 10 9
+push xs z; pop xs
+shift xs; echo $xs
+shift 2 xs; echo $xs
+push xs 10 a; uniq xs; reverse xs; echo $xs
+sort xs; echo $xs
+set ns 10 9 -1 2.5; sort -n ns; echo $ns
+contains xs a && echo yes
+contains xs q || echo no
+shift 9 xs
+sort -n xs
+set e; pop e
+func f { push xs local; echo $xs; push -g xs global }
+f; echo $xs`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "z\na b a 10 9\na 10 9\n9 10 a\n10 9 a\n-1 2.5 9 10\nyes\nno\n" +
+		"10 9 a local\n10 9 a global\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	want = "shift: can’t shift 9 elements off of a list of length 3\n" +
+		"sort: ‘a’ isn’t a valid number\n" +
+		"pop: the ‘e’ variable is empty\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestString(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+string upper a b
+echo héllo | string length
+string match -r '([a-z])(\d+)' a12 b
+string match -v 'a*' abc xyz
+string match -i 'A?C' abc && string match q x || echo none
+string replace -a o 0 foo; string replace -r '(o+)' '<$1>' foo
+string pad -w 4 ab; string pad -r -c . abc a
+string escape "it's"
+string join , a b c; string split -n 2 , a,b,c
+string sub -s 1 -l 2 hello
+string trim -c x xxhixx; string trim -lr ' a '
+string repeat 2 ab
+string bogus
+string pad -c ab x`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "A\nB\n5\na12\na\n12\nxyz\nabc\nnone\nf00\nf<oo>\n  ab\nabc\na..\n" +
+		"r#'it's'#\na,b,c\na\nb,c\nel\nhi\na\nabab\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	if s := errs.String(); !strings.HasPrefix(s, "string: unknown subcommand ‘bogus’\n") ||
+		!strings.HasSuffix(s, "string pad: ‘ab’ isn’t a single character\n") {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+set x foo.go; set xs a.txt b.go
+~ $x '*.c' '*.go' && echo glob
+~ $x 'F*' || ~ -i $x 'F*' && echo fold
+~ -l xs '*.go' && ~ -l xs '*.rs' || echo list
+if ~ -r -m m 2026-10-19 '(\d+)-(\d+)' { echo $#m $m }
+~ -l -m f xs '*.txt'; echo $f
+~ -r x '('`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "glob\nfold\nlist\n3 2026-10 2026 10\na.txt\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	if s := errs.String(); s != "~: error parsing regexp: missing closing ): `(`\n" {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.SetBytes(int64(len(largeScript)))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parse("", largeScript); err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	sh.Interactive = true
+	f := filepath.Join(t.TempDir(), "f")
+	sh.SetVar("f", f)
+
+	src := `
+false
+echo $status
+sh -c 'kill -TERM $$'
+echo $status
+echo foo >$f
+echo bar >$f
+echo $status
+exit-andy-test-command
+echo $status`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "1\nsigterm\nclobber:" + f + "\nexit-andy-test-command:executable file not found in $PATH\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestSignalExit(t *testing.T) {
+	sh, _, errs := newTestInterpreter()
+	err := sh.RunString("sh -c 'kill -TERM $$'")
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 128+15 {
+		t.Fatalf("Expected exit code 143 but got %v", err)
+	}
+	if s := errs.String(); s != "" {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+
+	sh.Interactive = true
+	sh.RunString("sh -c 'kill -TERM $$'; sh -c 'kill -PIPE $$'")
+	if s := errs.String(); s != "Terminated\n" {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+
+	src := `
+func sigusr2 { echo handled }
+signal
+signal -i usr2
+signal -l
+signal -r SIGUSR2
+signal
+type sigusr2
+signal -i foo
+signal -ir sigusr2`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	xs := strings.Split(out.String(), "\n")
+	if !slices.Contains(xs, "sigusr2 function") || !slices.Contains(xs, "sigusr2 ignored") ||
+		strings.Count(out.String(), "sigusr2") != 2 {
+		t.Fatalf("Stdout contained unexpected %q", out.String())
+	}
+	if _, ok := sh.sigs["sigusr2"]; ok {
+		t.Fatalf("Expected the ‘sigusr2’ handler to be removed")
+	}
+	if s := errs.String(); !strings.Contains(s, "signal: unknown signal ‘foo’\n") ||
+		!strings.HasSuffix(s, "Usage: signal [-l]\n       signal -i|-r signal ...\n") {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestSignalReset(t *testing.T) {
+	// Ignoring and resetting signals leaves alone those handled by the
+	// embedding program
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+
+	sh, out, _ := newTestInterpreter()
+	if err := sh.RunString("func sigusr1 {}; signal -r usr1; signal -i usr2; signal"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "sigusr2 ignored\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	for _, sig := range []syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2} {
+		syscall.Kill(os.Getpid(), sig)
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s to still be delivered", sig)
+		}
+	}
+
+	if err := sh.RunString("signal -r usr2"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected SIGUSR2 to still be delivered")
+	}
+}
+
+func TestSignalDispatch(t *testing.T) {
+	// The output of sh is discarded so that it isn’t copied into the
+	// buffer concurrently with the output of the handlers
+	sh, out, _ := newTestInterpreter()
+	src := `
+func sigusr1 { echo caught $_ }
+sh -c 'kill -USR1 $PPID; sleep 0.2' >_
+echo after
+func sigusr1 sig { echo abort $sig; false }
+for x in a b { sh -c 'kill -USR1 $PPID; sleep 0.2' >_; echo $x }
+echo unreachable`
+	err := sh.RunString(src)
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 1 {
+		t.Fatalf("Expected exit code 1 but got %v", err)
+	}
+	if s := out.String(); s != "caught sigusr1\nafter\nabort sigusr1\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestSignalForeground(t *testing.T) {
+	// Signals received while an async command waits are handled by the
+	// foreground once ‘wait’ returns, not by the async command
+	sh, out, _ := newTestInterpreter()
+	src := `
+func sigusr1 { echo handler; false }
+func job { sh -c 'kill -USR1 $PPID; sleep 0.2' >_; echo job }
+async --id=id job; wait $id
+echo unreachable`
+	err := sh.RunString(src)
+	if e, ok := err.(interface{ ExitCode() uint8 }); !ok || e.ExitCode() != 1 {
+		t.Fatalf("Expected exit code 1 but got %v", err)
+	}
+	if s := out.String(); s != "job\nhandler\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	sh.Interactive = true
+
+	for _, src := range []string{
+		"while true { true }; echo unreachable\necho unreachable",
+		"func f { sleep 10; echo unreachable }; f || echo unreachable",
+	} {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			sh.Interrupt()
+		}()
+		err := sh.RunString(src)
+		e, ok := err.(interface{ Status() string })
+		if !ok || e.Status() != "sigint" {
+			t.Fatalf("Expected status ‘sigint’ but got %v", err)
+		}
+		if xs, _ := sh.Var("status"); xs[0] != "sigint" {
+			t.Fatalf("Expected $status to be ‘sigint’ but got %q", xs)
+		}
+	}
+
+	// Deferred commands still run
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sh.Interrupt()
+	}()
+	sh.RunString("func f { defer { echo cleanup }; sleep 10 }; f")
+
+	if err := sh.RunString("echo after"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "cleanup\nafter\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestCdStack(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	dir := t.TempDir()
+	sh.Chdir(dir)
+
+	src := `
+cd /
+echo $cdstack
+cd /tmp | true
+async --id=id cd /tmp; wait $id
+echo $cdstack
+echo ` + "`" + `{cd /tmp; pwd}; pwd`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := dir + "\n" + dir + "\n" + "/tmp\n/\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+}
+
+func TestRead(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	dir := t.TempDir()
+	sh.Chdir(dir)
+	os.WriteFile(dir+"/in", []byte("foo bar\nbaz qux quux\na\x00b\x00"), 0666)
+
+	src := `
+{ read -l x; read -d' ' -n2 ys; read -l z; read -0 zs } <in
+echo $x; echo $#ys $ys; echo $z; echo $#zs $zs
+{ read -l x; cat } <in
+printf 'a\nb\nc' | { read -l x; read -l y; cat; echo; echo $x $y }
+printf 'a:b:\n' | read -Dd: xs; echo $#xs $xs
+printf 'a\n' | read x; echo $#x $x
+sleep 1 | read -t0.01 x || echo timed out
+read -t1 -l x <in; echo $x`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "foo bar\n2 baz qux\nquux\n2 a b\n" +
+		"baz qux quux\na\x00b\x00" +
+		"c\na b\n" +
+		"2 a b\n" +
+		"1 a\n" +
+		"timed out\n" +
+		"foo bar\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+
+	sh, _, errs := newTestInterpreter()
+	sh.Stdin = strings.NewReader("a\n")
+	if err := sh.RunString("read -t1 x"); err == nil {
+		t.Fatalf("Expected timeout on non-file input to fail")
+	}
+	if s := errs.String(); !strings.Contains(s, "timeouts are only supported") {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestProcSub(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	if sh.MaxSubstOutput <= 0 {
+		t.Fatalf("Expected the output of process substitutions to be limited")
+	}
+	sh.Interactive = true
+	sh.MaxSubstOutput = 4096
+
+	src := "set xs `(\\n){seq 1000}; echo $#xs $xs[-1]\n" +
+		"echo `(:: ,){printf 'a::b,c::'; printf ':d\\n\\n'}\n" +
+		"echo `{seq 2000}\n" +
+		"echo after"
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "1000 1000\na b c :d\n\nafter\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	want := "andy: output of process substitution exceeds 4096 bytes\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestProcSubFlags(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+
+	src := "echo `(-D -- :){printf 'a::b:'}\n" +
+		"echo `(-e -- :){printf 'a::b:'} x\n" +
+		"echo `(-r -- '[0-9]+' ,){printf 'a12b,,c3'}\n" +
+		"echo `(--){printf 'a--b'} `(-D :){printf 'a-Db'} `(-x -- :){printf 'a--b'}\n" +
+		"echo `(-De -- :){true}\n" +
+		"echo `(-r -- '('){true}"
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "a b\na  b  x\na b  c\na b a b a b\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	want := "andy: the ‘-D’ and ‘-e’ flags are mutually exclusive\n" +
+		"andy: error parsing regexp: missing closing ): `(`\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+
+	src := `
+split -D -s , -s ';' xs 'a,,b;c' 'd,'; echo $#xs $xs
+split -e -s , xs 'a,'; echo $#xs $xs
+split -r -s '\s+' xs 'foo   bar baz'; echo $#xs $xs
+split xs 'foo bar'; echo $#xs
+split -s , xs; echo $#xs
+split -De xs foo`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "4 a b c d\n2 a \n3 foo bar baz\n1\n0\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+	if s := errs.String(); !strings.HasPrefix(s, "Usage: split") {
+		t.Fatalf("Stderr contained unexpected %q", s)
+	}
+}
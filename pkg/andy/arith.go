@@ -0,0 +1,350 @@
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Arithmetic expressions are used by the ‘math’ builtin and ‘$[…]’
+// expansions.  Numbers are either integers or floats, and operations on two
+// integers give an integer; ‘7 / 2’ is 3 but ‘7 / 2.0’ is 3.5.  Variables may
+// be referred to as either ‘x’ or ‘$x’, and ‘$#x’ is the length of x.
+
+type arithExpr interface {
+	eval(lookup func(string) []string) (number, error)
+}
+
+type number struct {
+	i     int64
+	f     float64
+	float bool
+}
+
+func (n number) String() string {
+	if n.float {
+		return strconv.FormatFloat(n.f, 'g', -1, 64)
+	}
+	return strconv.FormatInt(n.i, 10)
+}
+
+func (n number) toFloat() float64 {
+	if n.float {
+		return n.f
+	}
+	return float64(n.i)
+}
+
+func parseNumber(s string) (number, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return number{i: i}, nil
+	} else if errors.Is(err, strconv.ErrRange) {
+		return number{}, fmt.Errorf("number ‘%s’ is out of range; what are you even doing?", s)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	switch {
+	case errors.Is(err, strconv.ErrRange):
+		return number{}, fmt.Errorf("number ‘%s’ is out of range; what are you even doing?", s)
+	case err != nil, math.IsInf(f, 0), math.IsNaN(f):
+		return number{}, fmt.Errorf("‘%s’ isn’t a valid number", s)
+	}
+	return number{f: f, float: true}, nil
+}
+
+type arithNum number
+
+type arithVar struct {
+	name   string
+	length bool
+}
+
+type arithUnary struct {
+	op  string
+	x   arithExpr
+	src string
+}
+
+type arithBinary struct {
+	op       string
+	lhs, rhs arithExpr
+	src      string
+}
+
+func (e arithNum) eval(_ func(string) []string) (number, error) {
+	return number(e), nil
+}
+
+func (e arithVar) eval(lookup func(string) []string) (number, error) {
+	xs := lookup(e.name)
+	if e.length {
+		return number{i: int64(len(xs))}, nil
+	}
+	if len(xs) != 1 {
+		return number{}, fmt.Errorf("the ‘%s’ variable isn’t a number", e.name)
+	}
+	n, err := parseNumber(strings.TrimSpace(xs[0]))
+	if err != nil {
+		return number{}, fmt.Errorf("the ‘%s’ variable isn’t a number", e.name)
+	}
+	return n, nil
+}
+
+func (e arithUnary) eval(lookup func(string) []string) (number, error) {
+	x, err := e.x.eval(lookup)
+	switch {
+	case err != nil, e.op == "+":
+		return x, err
+	case x.float:
+		return number{f: -x.f, float: true}, nil
+	case x.i == math.MinInt64:
+		return number{}, errOutOfRange(e.src)
+	}
+	return number{i: -x.i}, nil
+}
+
+func (e arithBinary) eval(lookup func(string) []string) (number, error) {
+	x, err := e.lhs.eval(lookup)
+	if err != nil {
+		return number{}, err
+	}
+	y, err := e.rhs.eval(lookup)
+	if err != nil {
+		return number{}, err
+	}
+
+	if (e.op == "/" || e.op == "%") && y.toFloat() == 0 {
+		return number{}, fmt.Errorf("division by zero in ‘%s’", e.src)
+	}
+	if x.float || y.float || e.op == "**" && y.i < 0 {
+		return floatOp(e.op, x.toFloat(), y.toFloat(), e.src)
+	}
+
+	a, b := x.i, y.i
+	var n int64
+	ok := true
+	switch e.op {
+	case "+":
+		n = a + b
+		ok = (n > a) == (b > 0)
+	case "-":
+		n = a - b
+		ok = (n < a) == (b > 0)
+	case "*":
+		n, ok = mulInt(a, b)
+	case "/":
+		n = a / b
+		ok = !(a == math.MinInt64 && b == -1)
+	case "%":
+		n = a % b
+	case "**":
+		n = 1
+		for ; b > 0 && ok; b >>= 1 {
+			if b&1 == 1 {
+				n, ok = mulInt(n, a)
+			}
+			if b > 1 && ok {
+				a, ok = mulInt(a, a)
+			}
+		}
+	}
+	if !ok {
+		return number{}, errOutOfRange(e.src)
+	}
+	return number{i: n}, nil
+}
+
+func mulInt(a, b int64) (int64, bool) {
+	n := a * b
+	return n, a == 0 || n/a == b && !(a == -1 && b == math.MinInt64)
+}
+
+func floatOp(op string, a, b float64, src string) (number, error) {
+	var n float64
+	switch op {
+	case "+":
+		n = a + b
+	case "-":
+		n = a - b
+	case "*":
+		n = a * b
+	case "/":
+		n = a / b
+	case "%":
+		n = math.Mod(a, b)
+	case "**":
+		n = math.Pow(a, b)
+	}
+	switch {
+	case math.IsInf(n, 0):
+		return number{}, errOutOfRange(src)
+	case math.IsNaN(n):
+		return number{}, fmt.Errorf("result of ‘%s’ isn’t a number", src)
+	}
+	return number{f: n, float: true}, nil
+}
+
+func errOutOfRange(src string) error {
+	return fmt.Errorf("result of ‘%s’ is out of range; what are you even doing?", src)
+}
+
+// parseArith parses the arithmetic expression s
+func parseArith(s string) (expr arithExpr, err error) {
+	p := arithParser{s: s}
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+		case parseError:
+			err = e.err
+		default:
+			panic(e)
+		}
+	}()
+
+	expr = p.sum()
+	if p.skipSpace(); p.pos < len(p.s) {
+		p.die("an operator")
+	}
+	return expr, nil
+}
+
+type arithParser struct {
+	s   string
+	pos int
+}
+
+// Operators in order of increasing precedence.  Exponentiation is handled
+// separately as it is right-associative.
+var arithOps = [][]string{{"+", "-"}, {"*", "/", "%"}}
+
+func (p *arithParser) die(want string) {
+	got := "end of expression"
+	if r, _ := utf8.DecodeRuneInString(p.s[p.pos:]); p.pos < len(p.s) {
+		got = "‘" + string(r) + "’"
+	}
+	panic(parseError{errExpected{want, got}})
+}
+
+func (p *arithParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes and returns the first of ops that comes next in the input
+func (p *arithParser) accept(ops ...string) (string, bool) {
+	p.skipSpace()
+	for _, op := range ops {
+		// Don’t mistake ‘**’ for ‘*’
+		if strings.HasPrefix(p.s[p.pos:], op) &&
+			(op != "*" || !strings.HasPrefix(p.s[p.pos:], "**")) {
+			p.pos += len(op)
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *arithParser) sum() arithExpr {
+	return p.binary(0)
+}
+
+func (p *arithParser) binary(prec int) arithExpr {
+	if prec == len(arithOps) {
+		return p.unary()
+	}
+	start := p.pos
+	x := p.binary(prec + 1)
+	for {
+		op, ok := p.accept(arithOps[prec]...)
+		if !ok {
+			return x
+		}
+		y := p.binary(prec + 1)
+		x = arithBinary{op, x, y, strings.TrimSpace(p.s[start:p.pos])}
+	}
+}
+
+func (p *arithParser) unary() arithExpr {
+	start := p.pos
+	if op, ok := p.accept("-", "+"); ok {
+		x := p.unary()
+		return arithUnary{op, x, strings.TrimSpace(p.s[start:p.pos])}
+	}
+	return p.power()
+}
+
+func (p *arithParser) power() arithExpr {
+	start := p.pos
+	x := p.atom()
+	if _, ok := p.accept("**"); ok {
+		y := p.unary()
+		return arithBinary{"**", x, y, strings.TrimSpace(p.s[start:p.pos])}
+	}
+	return x
+}
+
+func (p *arithParser) atom() arithExpr {
+	if _, ok := p.accept("("); ok {
+		x := p.sum()
+		if _, ok := p.accept(")"); !ok {
+			p.die("‘)’")
+		}
+		return x
+	}
+
+	p.skipSpace()
+	rest := p.s[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, "$#"):
+		p.pos += 2
+		return arithVar{name: p.ident(), length: true}
+	case strings.HasPrefix(rest, "$"):
+		p.pos++
+		return arithVar{name: p.ident()}
+	case rest != "" && (rest[0] == '.' || rest[0] >= '0' && rest[0] <= '9'):
+		return p.number()
+	case rest != "":
+		if r, _ := utf8.DecodeRuneInString(rest); isRefRune(r) {
+			return arithVar{name: p.ident()}
+		}
+	}
+	p.die("a number, variable, or ‘(’")
+	return nil
+}
+
+func (p *arithParser) ident() string {
+	n := strings.IndexFunc(p.s[p.pos:], func(r rune) bool {
+		return !isRefRune(r)
+	})
+	if n == -1 {
+		n = len(p.s) - p.pos
+	}
+	if n == 0 {
+		p.die("a variable name")
+	}
+	p.pos += n
+	return p.s[p.pos-n : p.pos]
+}
+
+func (p *arithParser) number() arithExpr {
+	start := p.pos
+loop:
+	for ; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; {
+		case c >= '0' && c <= '9', c == '.', c == 'e', c == 'E':
+		case (c == '+' || c == '-') && p.pos > start &&
+			(p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E'):
+		default:
+			break loop
+		}
+	}
+	n, err := parseNumber(p.s[start:p.pos])
+	if err != nil {
+		panic(parseError{err})
+	}
+	return arithNum(n)
+}
@@ -0,0 +1,76 @@
+package andy
+
+import "testing"
+
+func TestArith(t *testing.T) {
+	vars := map[string][]string{
+		"i":  {"5"},
+		"f":  {"0.5"},
+		"xs": {"a", "b", "c"},
+	}
+	lookup := func(name string) []string { return vars[name] }
+
+	for src, want := range map[string]string{
+		"1 + 2 * 3":   "7",
+		"(1 + 2) * 3": "9",
+		"7 / 2":       "3",
+		"7 / 2.0":     "3.5",
+		"-7 % 3":      "-1",
+		"2 ** 3 ** 2": "512",
+		"-2 ** 2":     "-4",
+		"2 ** -1":     "0.5",
+		"1e3":         "1000",
+		"i * $i - 1":  "24",
+		"$#xs + f":    "3.5",
+	} {
+		expr, err := parseArith(src)
+		if err != nil {
+			t.Fatalf("Failed to parse ‘%s’: %s", src, err)
+		}
+		n, err := expr.eval(lookup)
+		if err != nil {
+			t.Fatalf("Failed to evaluate ‘%s’: %s", src, err)
+		}
+		if s := n.String(); s != want {
+			t.Fatalf("Expected ‘%s’ to be %s but got %s", src, want, s)
+		}
+	}
+
+	for src, want := range map[string]string{
+		"1 +":   "Expected a number, variable, or ‘(’ but got end of expression",
+		"1 2":   "Expected an operator but got ‘2’",
+		"(1":    "Expected ‘)’ but got end of expression",
+		"1 / 0": "division by zero in ‘1 / 0’",
+		"9223372036854775807 + 1": "result of ‘9223372036854775807 + 1’ is out of range; " +
+			"what are you even doing?",
+		"xs + 1": "the ‘xs’ variable isn’t a number",
+	} {
+		expr, err := parseArith(src)
+		if err == nil {
+			_, err = expr.eval(lookup)
+		}
+		if err == nil || err.Error() != want {
+			t.Fatalf("Expected ‘%s’ to fail with ‘%s’ but got ‘%v’", src, want, err)
+		}
+	}
+}
+
+func TestArithExpansion(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	src := `
+set i 0; set xs a b c
+while test $i -lt 3 { set i $[i + 1] }
+echo $i x$[i * 2]y "$[$#xs - 1]" $xs[$[$#xs - 1]]
+math 2 '*' i + 0.5`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "3 x6y 2 c\n6.5\n" {
+		t.Fatalf("Stdout contained unexpected %q", s)
+	}
+
+	if _, err := Parse("echo $[1 +]"); err == nil || err.Error() !=
+		"1:6: Expected a number, variable, or ‘(’ but got end of expression" {
+		t.Fatalf("Expected a syntax error but got %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// See grammar.ebnf in the project root for details
+
+type astProgram = []astTopLevel
+
+type astTopLevel interface {
+	isTopLevel()
+}
+
+// The positions recorded in the AST are used for error messages and by the
+// formatter.  For nodes with a body, end is the position of the closing brace.
+
+type astFuncDef struct {
+	args     astList
+	body     []astTopLevel
+	pos, end position
+}
+
+type astCommandList struct {
+	lhs *astCommandList
+	op  astBinaryOp
+	rhs astPipeline
+
+	// The positions of the first and last tokens, only set on the outermost
+	// command list of a statement
+	pos, end position
+}
+
+type astXCommandList struct {
+	lhs astPipeline
+	op  astBinaryOp
+	rhs *astXCommandList
+}
+
+func (_ astFuncDef) isTopLevel()     {}
+func (_ astCommandList) isTopLevel() {}
+
+type astPipeline []astCleanCommand
+
+type astCleanCommand struct {
+	cmd astCommand
+	pos position
+}
+
+type astCommand interface {
+	isCommand()
+
+	redirs() []astRedirect
+	setRedirs([]astRedirect)
+}
+
+type astSimple struct {
+	args astList
+	rs   []astRedirect
+}
+
+type astCompound struct {
+	cmds []astTopLevel
+	rs   []astRedirect
+	end  position
+}
+
+type astIf struct {
+	cond         astCommandList
+	body, else_  []astTopLevel
+	rs           []astRedirect
+	end, elseEnd position
+}
+
+type astWhile struct {
+	cond astCommandList
+	body []astTopLevel
+	rs   []astRedirect
+	end  position
+}
+
+type astFor struct {
+	bind astValue
+	vals astList
+	body []astTopLevel
+	rs   []astRedirect
+	end  position
+}
+
+// An astDefer is code to run when the function it is in returns
+type astDefer struct {
+	body []astTopLevel
+	rs   []astRedirect
+	end  position
+}
+
+func (_ astSimple) isCommand()   {}
+func (_ astCompound) isCommand() {}
+func (_ astIf) isCommand()       {}
+func (_ astWhile) isCommand()    {}
+func (_ astFor) isCommand()      {}
+func (_ astDefer) isCommand()    {}
+
+func (c *astSimple) redirs() []astRedirect   { return c.rs }
+func (c *astCompound) redirs() []astRedirect { return c.rs }
+func (c *astIf) redirs() []astRedirect       { return c.rs }
+func (c *astWhile) redirs() []astRedirect    { return c.rs }
+func (c *astFor) redirs() []astRedirect      { return c.rs }
+func (c *astDefer) redirs() []astRedirect    { return c.rs }
+
+func (c *astSimple) setRedirs(rs []astRedirect)   { c.rs = rs }
+func (c *astCompound) setRedirs(rs []astRedirect) { c.rs = rs }
+func (c *astIf) setRedirs(rs []astRedirect)       { c.rs = rs }
+func (c *astWhile) setRedirs(rs []astRedirect)    { c.rs = rs }
+func (c *astFor) setRedirs(rs []astRedirect)      { c.rs = rs }
+func (c *astDefer) setRedirs(rs []astRedirect)    { c.rs = rs }
+
+type astRedirect struct {
+	kind redirKind
+	file astValue
+	pos  position
+}
+
+type redirKind int
+
+const (
+	redirAppend redirKind = iota
+	redirClob
+	redirRead
+	redirWrite
+	redirSockRead
+	redirSockWrite
+)
+
+func newRedir(k tokenKind) astRedirect {
+	switch k {
+	case tokAppend:
+		return astRedirect{kind: redirAppend}
+	case tokClobber:
+		return astRedirect{kind: redirClob}
+	case tokRead:
+		return astRedirect{kind: redirRead}
+	case tokWrite:
+		return astRedirect{kind: redirWrite}
+	}
+	panic("unreachable")
+}
+
+type astValue interface {
+	isValue()
+}
+
+type astArgument string
+
+// astTilde is a lone unquoted ‘~’.  Unlike words starting with one it is
+// never expanded, so that it always names the ~ builtin.
+type astTilde struct{}
+
+func tildeExpand(s string) (string, error) {
+	if len(s) == 0 || s[0] != '~' {
+		return s, nil
+	}
+	i := strings.IndexByte(s, '/')
+	if i == -1 {
+		i = len(s)
+	}
+
+	if i == 1 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return home + s[i:], nil
+	}
+
+	name := s[1:i]
+	switch u, err := user.Lookup(name); {
+	case errors.Is(err, user.UnknownUserError(name)):
+		return s, nil
+	case err != nil:
+		return "", err
+	default:
+		return u.HomeDir + s[i:], nil
+	}
+}
+
+type astString string
+
+type varRefKind int
+
+const (
+	vrExpand varRefKind = iota
+	vrFlatten
+	vrLength
+)
+
+type astVarRef struct {
+	ident   astValue
+	repl    astValue
+	kind    varRefKind
+	indices astList
+	pos     position
+}
+
+func stoi(s string) (int, commandResult) {
+	n, err := strconv.Atoi(s)
+	err, ok := err.(*strconv.NumError)
+	if !ok {
+		return n, nil
+	}
+
+	var es string
+	switch {
+	case errors.Is(err, strconv.ErrRange):
+		es = fmt.Sprintf("index ‘%s’ is out of range; what are you even doing?", s)
+	case errors.Is(err, strconv.ErrSyntax):
+		es = fmt.Sprintf("‘%s’ isn’t a valid index", s)
+	}
+
+	return 0, errInternal{errors.New(es)}
+}
+
+func getIndexRange(s string, n int) (int, int, commandResult) {
+	b, a, f := strings.Cut(s, "..")
+	i, err := stoi(b)
+	if cmdFailed(err) {
+		return 0, 0, err
+	}
+
+	var j int
+	switch {
+	case f && a != "":
+		j, err = stoi(a)
+		if cmdFailed(err) {
+			return 0, 0, err
+		}
+	case f:
+		j = n
+	default:
+		j = i + 1
+	}
+
+	return i, j, nil
+}
+
+// lookupVar returns the value of the variable ident, preferring local
+// variables over global ones over environment variables.  The value of a map
+// is its sorted keys.
+func lookupVar(ctx context, ident string) []string {
+	if xs, ok := ctx.scope[ident]; ok {
+		return xs
+	}
+	if mv, ok := ctx.maps[ident]; ok {
+		return mv.keys()
+	}
+	if xs, ok := ctx.sh.vars[ident]; ok {
+		return xs
+	}
+	if mv, ok := ctx.sh.maps[ident]; ok {
+		return mv.keys()
+	}
+	if x, ok := ctx.sh.LookupEnv(ident); ok {
+		return []string{x}
+	}
+	return nil
+}
+
+// indexList returns the elements of xs selected by the indices and ranges in
+// ss
+func indexList(xs, ss []string) ([]string, commandResult) {
+	n := len(xs)
+	ys := make([]string, 0, n)
+	for _, s := range ss {
+		i, j, res := getIndexRange(s, n)
+		if cmdFailed(res) {
+			return nil, res
+		}
+
+		I, J := i, j
+		if I < 0 {
+			I += n
+		}
+		if J < 0 {
+			J += n
+		}
+
+		if i < j {
+			switch {
+			case I < 0, I >= n:
+				return nil, errInvalidIndex{i, n}
+			case J < 0, J > n:
+				return nil, errInvalidIndex{j, n}
+			}
+
+			for k := i; k < j; k++ {
+				k := k
+				if k < 0 {
+					k += n
+				}
+				ys = append(ys, xs[k])
+			}
+		} else {
+			switch {
+			case I < 0, I > n:
+				return nil, errInvalidIndex{i, n}
+			case J < 0, J >= n:
+				return nil, errInvalidIndex{j, n}
+			}
+
+			for k := i - 1; k >= j; k-- {
+				k := k
+				if k < 0 {
+					k += n
+				}
+				ys = append(ys, xs[k])
+			}
+		}
+	}
+	return ys, nil
+}
+
+func newVarRef(t token) astVarRef {
+	vr := astVarRef{pos: t.pos}
+	if t.val == "" {
+		vr.ident = nil
+	} else {
+		vr.ident = astArgument(t.val)
+	}
+	switch t.kind {
+	case tokVarFlat:
+		vr.kind = vrFlatten
+	case tokVarLen:
+		vr.kind = vrLength
+	}
+	return vr
+}
+
+// An astArith is an arithmetic expansion such as ‘$[x + 1]’
+type astArith struct {
+	expr arithExpr
+	src  string
+}
+
+type astConcat struct {
+	lhs, rhs astValue
+}
+
+type astList []astValue
+
+type astProcSub struct {
+	seps astList
+	body []astTopLevel
+	end  position
+}
+
+type astProcRedir struct {
+	kind procRedirKind
+	body []astTopLevel
+	end  position
+}
+
+func (pr astProcRedir) is(t procRedirKind) bool {
+	return pr.kind&t != 0
+}
+
+type procRedirKind int
+
+const (
+	procRead procRedirKind = 1 << iota
+	procWrite
+)
+
+func (_ astArgument) isValue()   {}
+func (_ astString) isValue()     {}
+func (_ astTilde) isValue()      {}
+func (_ astVarRef) isValue()     {}
+func (_ astArith) isValue()      {}
+func (_ astConcat) isValue()     {}
+func (_ astList) isValue()       {}
+func (_ astProcSub) isValue()    {}
+func (_ *astProcRedir) isValue() {}
+
+type astBinaryOp int
+
+const (
+	binAnd astBinaryOp = iota
+	binOr
+)
@@ -0,0 +1,1418 @@
+package andy
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+var (
+	builtins      = make(map[string]*Builtin, 32)
+	reservedNames = []string{"cdstack", "pid", "ppid", "status"}
+)
+
+type asyncState struct {
+	wg  sync.WaitGroup
+	wgs map[uint64]*sync.WaitGroup
+	mtx sync.Mutex
+	nId atomic.Uint64
+}
+
+func init() {
+	for _, b := range []*Builtin{
+		{
+			Name:    "!",
+			Usage:   []string{"! command [argument ...]"},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdBang,
+		},
+		{
+			Name: "~",
+			Usage: []string{
+				"~ [-ir] [-m variable] subject pattern ...",
+				"~ -l [-gir] [-m variable] variable pattern ...",
+			},
+			Flags: []Flag{
+				{
+					Short: 'g',
+					Long:  "global",
+					Help:  "use global variables",
+				},
+				{
+					Short: 'i',
+					Long:  "ignore-case",
+					Help:  "match case-insensitively",
+				},
+				{
+					Short: 'l',
+					Long:  "list",
+					Help:  "match the elements of the list ‘variable’ instead of ‘subject’",
+				},
+				{
+					Short: 'm',
+					Long:  "match",
+					Arg:   opts.Required,
+					Value: "variable",
+					Help:  "set ‘variable’ to the first match and its capture groups",
+				},
+				{
+					Short: 'r',
+					Long:  "regexp",
+					Help:  "treat each ‘pattern’ as a regular expression",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdTilde,
+		},
+		{
+			Name:  "async",
+			Usage: []string{"async [-i [var]] command [argument ...]"},
+			Flags: []Flag{{
+				Short: 'i',
+				Long:  "id",
+				Arg:   opts.Optional,
+				Value: "var",
+				Help:  "store the job ID in ‘var’, or ‘_’ if no variable is given",
+			}},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdAsync,
+		},
+		{
+			Name:  "call",
+			Usage: []string{"call [-bc] command [argument ...]"},
+			Flags: []Flag{
+				{Short: 'b', Long: "builtin", Help: "only call builtins"},
+				{Short: 'c', Long: "command", Help: "only call external commands"},
+			},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdCall,
+		},
+		{
+			Name:    "cd",
+			Usage:   []string{"cd [directory]"},
+			MaxArgs: 1,
+			Run:     cmdCd,
+		},
+		{
+			Name:  "contains",
+			Usage: []string{"contains [-g] variable value"},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 2,
+			MaxArgs: 2,
+			Run:     cmdContains,
+		},
+		{
+			Name:    "echo",
+			Usage:   []string{"echo [argument ...]"},
+			RawArgs: true,
+			Run:     cmdEcho,
+		},
+		{
+			Name:    "eval",
+			Usage:   []string{"eval [file ...]"},
+			MaxArgs: Unlimited,
+			Run:     cmdEval,
+		},
+		{
+			Name:  "exec",
+			Usage: []string{"exec [-z argument] command [argument ...]"},
+			Flags: []Flag{{
+				Short: 'z',
+				Long:  "zero",
+				Arg:   opts.Required,
+				Value: "argument",
+				Help:  "pass ‘argument’ as the zeroth argument of the command",
+			}},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdExec,
+		},
+		{
+			Name:    "exit",
+			Usage:   []string{"exit [code]"},
+			MaxArgs: 1,
+			Run:     cmdExit,
+		},
+		{
+			Name:    "false",
+			Usage:   []string{"false"},
+			RawArgs: true,
+			Run:     cmdFalse,
+		},
+		{
+			Name: "get",
+			Usage: []string{
+				"get [-g] [-Dd string] variable ...",
+				"get -e [-D string] variable ...",
+			},
+			Flags: []Flag{
+				{
+					Short: 'D',
+					Long:  "var-delimiter",
+					Arg:   opts.Required,
+					Value: "string",
+					Help:  "separate variables with ‘string’",
+				},
+				{
+					Short: 'd',
+					Long:  "item-delimiter",
+					Arg:   opts.Required,
+					Value: "string",
+					Help:  "separate list items with ‘string’",
+				},
+				{
+					Short: 'e',
+					Long:  "environment",
+					Help:  "get environment variables",
+				},
+				{
+					Short: 'g',
+					Long:  "global",
+					Help:  "get global variables",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdGet,
+		},
+		{
+			Name:    "math",
+			Usage:   []string{"math expression ..."},
+			RawArgs: true,
+			Run:     cmdMath,
+		},
+		{
+			Name:  "pop",
+			Usage: []string{"pop [-g] variable"},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run:     cmdPop,
+		},
+		{
+			Name:  "push",
+			Usage: []string{"push [-g] variable value ..."},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 2,
+			MaxArgs: Unlimited,
+			Run:     cmdPush,
+		},
+		{
+			Name:  "quote",
+			Usage: []string{"quote [-d string] variable ..."},
+			Flags: []Flag{{
+				Short: 'd',
+				Long:  "delimiter",
+				Arg:   opts.Required,
+				Value: "string",
+				Help:  "separate quoted arguments with ‘string’",
+			}},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdQuote,
+		},
+		{
+			Name:  "read",
+			Usage: []string{"read [-0Dgls] [-d string] [-n num] [-p prompt] [-t seconds] variable"},
+			Flags: []Flag{
+				{
+					Short: '0',
+					Long:  "null",
+					Help:  "split fields on NUL bytes",
+				},
+				{
+					Short: 'D',
+					Long:  "no-empty",
+					Help:  "discard empty fields",
+				},
+				{
+					Short: 'd',
+					Long:  "delimiters",
+					Arg:   opts.Required,
+					Value: "string",
+					Help:  "split fields on any of the bytes in ‘string’",
+				},
+				{
+					Short: 'g',
+					Long:  "global",
+					Help:  "set a global variable",
+				},
+				{
+					Short: 'l',
+					Long:  "line",
+					Help:  "read a single line",
+				},
+				{
+					Short: 'n',
+					Long:  "count",
+					Arg:   opts.Required,
+					Value: "num",
+					Help:  "read at most ‘num’ fields",
+				},
+				{
+					Short: 'p',
+					Long:  "prompt",
+					Arg:   opts.Required,
+					Value: "prompt",
+					Help:  "print ‘prompt’ to standard error before reading",
+				},
+				{
+					Short: 's',
+					Long:  "silent",
+					Help:  "don’t echo input typed on a terminal",
+				},
+				{
+					Short: 't',
+					Long:  "timeout",
+					Arg:   opts.Required,
+					Value: "seconds",
+					Help:  "fail if the input isn’t read within ‘seconds’",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run:     cmdRead,
+		},
+		{
+			Name:  "rehash",
+			Usage: []string{"rehash"},
+			Run:   cmdRehash,
+		},
+		{
+			Name:  "reverse",
+			Usage: []string{"reverse [-g] variable"},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run:     cmdReverse,
+		},
+		{
+			Name: "set",
+			Usage: []string{
+				"set [-g] variable [value ...]",
+				"set -a|-p [-g] variable value ...",
+				"set -e variable [value]",
+			},
+			Flags: []Flag{
+				{
+					Short: 'a',
+					Long:  "append",
+					Help:  "append values to the variable",
+				},
+				{
+					Short: 'e',
+					Long:  "environment",
+					Help:  "set an environment variable",
+				},
+				{
+					Short: 'g',
+					Long:  "global",
+					Help:  "set a global variable",
+				},
+				{
+					Short: 'p',
+					Long:  "prepend",
+					Help:  "prepend values to the variable",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdSet,
+		},
+		{
+			Name:  "shift",
+			Usage: []string{"shift [-g] [count] variable"},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 1,
+			MaxArgs: 2,
+			Run:     cmdShift,
+		},
+		{
+			Name: "signal",
+			Usage: []string{
+				"signal [-l]",
+				"signal -i|-r signal ...",
+			},
+			Flags: []Flag{
+				{
+					Short: 'i',
+					Long:  "ignore",
+					Help:  "ignore the signals, removing their handler functions",
+				},
+				{
+					Short: 'l',
+					Long:  "list",
+					Help:  "list handled and ignored signals (the default)",
+				},
+				{
+					Short: 'r',
+					Long:  "reset",
+					Help:  "restore the default behavior of the signals, removing their handler functions",
+				},
+			},
+			MaxArgs: Unlimited,
+			Run:     cmdSignal,
+		},
+		{
+			Name:  "sort",
+			Usage: []string{"sort [-gn] variable"},
+			Flags: []Flag{
+				{
+					Short: 'g',
+					Long:  "global",
+					Help:  "use a global variable",
+				},
+				{
+					Short: 'n',
+					Long:  "numeric",
+					Help:  "sort by numeric value",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run:     cmdSort,
+		},
+		{
+			Name:  "split",
+			Usage: []string{"split [-Degr] [-s separator] variable [string ...]"},
+			Flags: append(slices.Clone(splitFlags),
+				Flag{
+					Short: 'g',
+					Long:  "global",
+					Help:  "set a global variable",
+				},
+				Flag{
+					Short: 's',
+					Long:  "separator",
+					Arg:   opts.Required,
+					Value: "separator",
+					Help:  "split on ‘separator’, which may be given more than once",
+				},
+			),
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdSplit,
+		},
+		{
+			Name:    "string",
+			Usage:   stringUsage(),
+			RawArgs: true,
+			Run:     cmdString,
+		},
+		{
+			Name:    "true",
+			Usage:   []string{"true"},
+			RawArgs: true,
+			Run:     cmdTrue,
+		},
+		{
+			Name:  "type",
+			Usage: []string{"type [-as] identifier ..."},
+			Flags: []Flag{
+				{
+					Short: 'a',
+					Long:  "all",
+					Help:  "print every match instead of only the first",
+				},
+				{
+					Short: 's',
+					Long:  "source",
+					Help:  "print the source code of functions",
+				},
+			},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdType,
+		},
+		{
+			Name:  "uniq",
+			Usage: []string{"uniq [-g] variable"},
+			Flags: []Flag{{
+				Short: 'g',
+				Long:  "global",
+				Help:  "use a global variable",
+			}},
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run:     cmdUniq,
+		},
+		{
+			Name:    "umask",
+			Usage:   []string{"umask [mask]"},
+			MaxArgs: 1,
+			Run:     cmdUmask,
+		},
+		{
+			Name:    "whatis",
+			Usage:   []string{"whatis name ..."},
+			MinArgs: 1,
+			MaxArgs: Unlimited,
+			Run:     cmdWhatis,
+		},
+		{
+			Name:    "wait",
+			Usage:   []string{"wait [id ...]"},
+			MaxArgs: Unlimited,
+			Run:     cmdWait,
+		},
+	} {
+		builtins[b.Name] = b
+	}
+}
+
+func cmdBang(c *Call) uint8 {
+	if res := execPreparedCommand(c.command(c.Args), c.ctx); cmdFailed(res) {
+		return 0
+	}
+	return 1
+}
+
+func cmdTilde(c *Call) uint8 {
+	xs := c.Args[:1]
+	if c.Has('l') {
+		var err error
+		if xs, err = varValue(c.ctx, c.Args[0], c.Has('g')); err != nil {
+			return c.Errorf("%s", err)
+		}
+	}
+
+	res := make([]*regexp.Regexp, len(c.Args)-1)
+	for i, pat := range c.Args[1:] {
+		var err error
+		switch {
+		case !c.Has('r'):
+			res[i], err = compileGlob(pat, c.Has('i'))
+		case c.Has('i'):
+			res[i], err = regexp.Compile("(?i)" + pat)
+		default:
+			res[i], err = regexp.Compile(pat)
+		}
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+	}
+
+	for _, x := range xs {
+		for _, re := range res {
+			m := re.FindStringSubmatch(x)
+			if m == nil {
+				continue
+			}
+			if mvar, ok := c.Flag('m'); ok {
+				if err := setVar(c.ctx, mvar, c.Has('g'), m); err != nil {
+					return c.Errorf("%s", err)
+				}
+			}
+			return 0
+		}
+	}
+	return 1
+}
+
+func cmdAsync(c *Call) uint8 {
+	var id uint64
+	ivar, iflag := c.Flag('i')
+	if iflag {
+		if ivar == "" {
+			ivar = "_"
+		}
+		if ok, r := isRefName(ivar); !ok {
+			return c.Errorf("rune ‘%c’ is not allowed in variable names", r)
+		}
+		id = c.Sh.async.nId.Add(1)
+	}
+
+	cmd := c.command(c.Args)
+	ctx := c.ctx
+	ctx.wd = ctx.wd.fork()
+	ctx.exit = ctx.exit.fork()
+	ctx.fg = false
+	c.Sh.async.wg.Add(1)
+	if id > 0 {
+		c.Sh.async.mtx.Lock()
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		c.Sh.async.wgs[id] = wg
+		c.Sh.async.mtx.Unlock()
+		c.Sh.vars[ivar] = []string{strconv.FormatUint(id, 10)}
+	}
+	go func() {
+		defer c.Sh.async.wg.Done()
+		if id > 0 {
+			defer func() {
+				c.Sh.async.mtx.Lock()
+				c.Sh.async.wgs[id].Done()
+				delete(c.Sh.async.wgs, id)
+				c.Sh.async.mtx.Unlock()
+			}()
+		}
+		_ = execPreparedCommand(cmd, ctx)
+	}()
+
+	return 0
+}
+
+func cmdCall(c *Call) uint8 {
+	bflag, cflag := c.Has('b'), c.Has('c')
+	if !bflag && !cflag {
+		bflag = true
+		cflag = true
+	}
+
+	if bflag {
+		if b, ok := c.Sh.builtins[c.Args[0]]; ok {
+			return b.call(c.command(c.Args), c.ctx)
+		}
+	}
+
+	if cflag {
+		var err error
+		cmd := c.command(c.Args)
+		if cmd.Path, err = c.Sh.lookPath(c.ctx, cmd.Path); err != nil {
+			return c.Errorf("%s", err)
+		}
+		err = cmd.Run()
+		code := cmd.ProcessState.ExitCode()
+
+		if err != nil && code == -1 {
+			return c.Errorf("%s", err)
+		}
+		return uint8(code)
+	}
+
+	return 1
+}
+
+func cmdCd(c *Call) uint8 {
+	// Only the root directory stack is visible; pipeline stages and
+	// async jobs work on forks of it
+	if c.ctx.wd == &c.Sh.wd {
+		defer func() {
+			c.Sh.vars["cdstack"] = c.ctx.wd.stack
+		}()
+	}
+
+	var dst string
+	switch len(c.Args) {
+	case 0:
+		user, err := user.Current()
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+		dst = user.HomeDir
+	case 1:
+		dst = c.Args[0]
+		if dst == "-" {
+			return cdPop(c)
+		}
+	}
+
+	cwd := c.ctx.wd.cwd
+	if err := chdir(c.ctx, dst); err != nil {
+		return c.Errorf("%s", err)
+	}
+	c.ctx.wd.stack.Push(cwd)
+	return 0
+}
+
+func cdPop(c *Call) uint8 {
+	if dst, ok := c.ctx.wd.stack.Pop(); !ok {
+		return c.Errorf("the directory stack is empty")
+	} else if err := chdir(c.ctx, dst); err != nil {
+		return c.Errorf("%s", err)
+	}
+	return 0
+}
+
+// chdir changes the working directory of ctx to dst without touching the
+// working directory of the process
+func chdir(ctx context, dst string) error {
+	path := ctx.resolve(dst)
+	switch info, err := os.Stat(path); {
+	case err != nil:
+		return &os.PathError{Op: "chdir", Path: dst, Err: errors.Unwrap(err)}
+	case !info.IsDir():
+		return &os.PathError{Op: "chdir", Path: dst, Err: syscall.ENOTDIR}
+	}
+
+	ctx.wd.cwd = path
+	return nil
+}
+
+func cmdContains(c *Call) uint8 {
+	xs, err := varValue(c.ctx, c.Args[0], c.Has('g'))
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	if slices.Contains(xs, c.Args[1]) {
+		return 0
+	}
+	return 1
+}
+
+func cmdEcho(c *Call) uint8 {
+	// Cast to []any
+	args := make([]any, len(c.Args))
+	for i := range args {
+		args[i] = c.Args[i]
+	}
+
+	fmt.Fprintln(c.Stdout, args...)
+	return 0
+}
+
+func cmdEval(c *Call) uint8 {
+	if len(c.Args) == 0 {
+		c.Args = []string{"-"}
+	}
+	for _, f := range c.Args {
+		var (
+			buf []byte
+			err error
+		)
+
+		if f == "-" {
+			buf, err = io.ReadAll(c.Stdin)
+		} else {
+			buf, err = os.ReadFile(c.ctx.resolve(f))
+		}
+
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+
+		prog, err := ParseFile(f, string(buf))
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+		runAll(prog.stmts, c.ctx)
+	}
+	return 0
+}
+
+func cmdExec(c *Call) uint8 {
+	args := c.Args
+	argv0, err := c.Sh.lookPath(c.ctx, args[0])
+	if err != nil {
+		return c.Errorf("unable to find ‘%s’ in $PATH", args[0])
+	}
+	if zeroth, ok := c.Flag('z'); ok {
+		args[0] = zeroth
+	}
+	if err := os.Chdir(c.ctx.wd.cwd); err != nil {
+		return c.Errorf("%s", err)
+	}
+	err = syscall.Exec(argv0, args, c.Sh.Environ())
+	return c.Errorf("failed to exec ‘%s’: %s", argv0, err)
+}
+
+func cmdExit(c *Call) uint8 {
+	lo, hi := 0, math.MaxUint8
+
+	var n int
+	if len(c.Args) > 0 {
+		var err error
+		s := c.Args[0]
+		n, err = strconv.Atoi(s)
+		switch {
+		case errors.Is(err, strconv.ErrRange) || n < lo || n > hi:
+			return c.Errorf("exit code ‘%s’ must be in the range %d–%d", s, lo, hi)
+		case err != nil:
+			return c.Errorf("‘%s’ isn’t a valid integer", s)
+		}
+	}
+
+	if c.ctx.exit == c.Sh.exit {
+		c.Sh.exitShell(uint8(n))
+	} else {
+		// Exiting a subshell only stops the subshell
+		c.ctx.exit.set(uint8(n))
+	}
+	return uint8(n)
+}
+
+func cmdFalse(_ *Call) uint8 {
+	return 1
+}
+
+func cmdGet(c *Call) uint8 {
+	itemD, varD := "\n", "\n"
+	eflag, gflag := c.Has('e'), c.Has('g')
+	if d, ok := c.Flag('d'); ok {
+		if eflag {
+			return c.Usage()
+		}
+		itemD = d
+	}
+	if d, ok := c.Flag('D'); ok {
+		varD = d
+	}
+	if eflag && gflag {
+		return c.Usage()
+	}
+
+	vals := make([][]string, len(c.Args))
+	for i, a := range c.Args {
+		name, _, _ := splitMapRef(a)
+		if ok, r := isRefName(name); !ok {
+			return c.Errorf("rune ‘%c’ is not allowed in variable names", r)
+		}
+		if eflag {
+			v, _ := c.Sh.LookupEnv(a)
+			vals[i] = []string{v}
+			continue
+		}
+		xs, err := varValue(c.ctx, a, gflag)
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+		vals[i] = xs
+	}
+
+	for i, xs := range vals {
+		for i, s := range xs {
+			fmt.Fprint(c.Stdout, s)
+			if i < len(xs)-1 {
+				fmt.Fprint(c.Stdout, itemD)
+			}
+		}
+		if i < len(vals)-1 {
+			fmt.Fprint(c.Stdout, varD)
+		}
+	}
+	fmt.Fprint(c.Stdout, "\n")
+
+	return 0
+}
+
+func cmdMath(c *Call) uint8 {
+	if len(c.Args) == 0 {
+		return c.Usage()
+	}
+	expr, err := parseArith(strings.Join(c.Args, " "))
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	n, err := expr.eval(func(name string) []string {
+		return lookupVar(c.ctx, name)
+	})
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	fmt.Fprintln(c.Stdout, n)
+	return 0
+}
+
+func cmdPop(c *Call) uint8 {
+	var x string
+	ident := c.Args[0]
+	res := modifyVar(c, ident, func(xs []string) ([]string, error) {
+		if len(xs) == 0 {
+			return nil, fmt.Errorf("the ‘%s’ variable is empty", ident)
+		}
+		x = xs[len(xs)-1]
+		return xs[: len(xs)-1 : len(xs)-1], nil
+	})
+	if res == 0 {
+		fmt.Fprintln(c.Stdout, x)
+	}
+	return res
+}
+
+func cmdPush(c *Call) uint8 {
+	return modifyVar(c, c.Args[0], func(xs []string) ([]string, error) {
+		return append(slices.Clip(xs), c.Args[1:]...), nil
+	})
+}
+
+func cmdQuote(c *Call) uint8 {
+	delim := "\n"
+	if d, ok := c.Flag('d'); ok {
+		delim = d
+	}
+
+	for i, arg := range c.Args {
+		fmt.Fprint(c.Stdout, rawString(arg))
+		if i < len(c.Args)-1 {
+			fmt.Fprint(c.Stdout, delim)
+		}
+	}
+	fmt.Fprint(c.Stdout, "\n")
+	return 0
+}
+
+// rawString returns s as a raw string with enough ‘#’s that it can hold s
+// as-is
+func rawString(s string) string {
+	d := "'#"
+	for strings.Contains(s, d) {
+		d += "#"
+	}
+	return "r" + d[1:] + "'" + s + d
+}
+
+func cmdRead(c *Call) uint8 {
+	var ds []byte
+	var timeout time.Duration
+	cnt := math.MaxInt
+	for _, f := range c.Flags {
+		switch f.Key {
+		case '0':
+			ds = []byte{0}
+		case 'd':
+			ds = []byte(f.Value)
+		case 'n':
+			n, err := strconv.Atoi(f.Value)
+			if err != nil {
+				c.Errorf("%s", err)
+				return c.Usage()
+			}
+			cnt = n
+		case 't':
+			n, err := strconv.ParseFloat(f.Value, 64)
+			if err != nil || n < 0 {
+				return c.Errorf("‘%s’ isn’t a valid timeout", f.Value)
+			}
+			timeout = time.Duration(n * float64(time.Second))
+		}
+	}
+	if c.Has('l') {
+		if c.Has('n') {
+			return c.Usage()
+		}
+		cnt = 1
+		if ds == nil {
+			ds = []byte{'\n'}
+		}
+	}
+
+	in := c.Stdin
+	if f, ok := in.(*os.File); ok && c.Has('s') {
+		defer noEcho(f)()
+		defer fmt.Fprintln(c.Stderr)
+	}
+	if p, ok := c.Flag('p'); ok {
+		fmt.Fprint(c.Stderr, p)
+	}
+	if c.Has('t') {
+		// Reads of other readers can’t be abandoned without losing
+		// whatever they eventually read
+		f, ok := in.(*os.File)
+		if !ok {
+			return c.Errorf("timeouts are only supported when reading from files")
+		}
+		g, done, err := deadlineFile(f, time.Now().Add(timeout))
+		if err != nil {
+			return c.Errorf("%s", err)
+		}
+		defer done()
+		in = g
+	}
+
+	r := newInputReader(in, cnt == math.MaxInt)
+	defer r.Close()
+
+	var timedOut bool
+	sb := strings.Builder{}
+	parts := []string{}
+outer:
+	for cnt > 0 {
+		b, err := r.ReadByte()
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, os.ErrDeadlineExceeded):
+			timedOut = errors.Is(err, os.ErrDeadlineExceeded)
+			if sb.Len() > 0 {
+				parts = append(parts, sb.String())
+			}
+			break outer
+		case err != nil:
+			return c.Errorf("%s", err)
+		}
+
+		if bytes.IndexByte(ds, b) != -1 {
+			cnt--
+			parts = append(parts, sb.String())
+			sb.Reset()
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+
+	if n := len(parts); n > 0 {
+		parts[n-1] = strings.TrimSuffix(parts[n-1], "\n")
+	}
+
+	if c.Has('D') {
+		parts = slices.DeleteFunc(parts, func(s string) bool {
+			return s == ""
+		})
+	}
+
+	ident := c.Args[0]
+	var err error
+	if len(parts) == 0 {
+		err = unsetVar(c.ctx, ident, c.Has('g'))
+	} else {
+		err = setVar(c.ctx, ident, c.Has('g'), parts)
+	}
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	if len(parts) == 0 || timedOut {
+		return 1
+	}
+	return 0
+}
+
+func cmdReverse(c *Call) uint8 {
+	return modifyVar(c, c.Args[0], func(xs []string) ([]string, error) {
+		xs = slices.Clone(xs)
+		slices.Reverse(xs)
+		return xs, nil
+	})
+}
+
+func cmdSet(c *Call) uint8 {
+	aflag, eflag, gflag, pflag := c.Has('a'), c.Has('e'), c.Has('g'), c.Has('p')
+	switch {
+	case eflag && len(c.Args) > 2, eflag && (aflag || gflag || pflag),
+		aflag && pflag, (aflag || pflag) && len(c.Args) == 1:
+		return c.Usage()
+	}
+
+	var err error
+	ident := c.Args[0]
+	_, _, isMap := splitMapRef(ident)
+	switch {
+	case eflag && isMap:
+		err = errors.New("elements of maps can’t be environment variables")
+	case eflag && len(c.Args) == 1:
+		c.Sh.Unsetenv(ident)
+	case eflag:
+		err = c.Sh.Setenv(ident, c.Args[1])
+	case aflag, pflag:
+		var xs []string
+		if xs, err = varValue(c.ctx, ident, gflag); err != nil {
+			break
+		}
+		if aflag {
+			xs = append(slices.Clip(xs), c.Args[1:]...)
+		} else {
+			xs = append(slices.Clone(c.Args[1:]), xs...)
+		}
+		err = setVar(c.ctx, ident, gflag, xs)
+	case len(c.Args) == 1:
+		err = unsetVar(c.ctx, ident, gflag)
+	default:
+		err = setVar(c.ctx, ident, gflag, c.Args[1:])
+	}
+
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	return 0
+}
+
+func cmdShift(c *Call) uint8 {
+	n := 1
+	if len(c.Args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(c.Args[0]); err != nil || n < 0 {
+			return c.Errorf("‘%s’ isn’t a valid count", c.Args[0])
+		}
+	}
+	return modifyVar(c, c.Args[len(c.Args)-1], func(xs []string) ([]string, error) {
+		if n > len(xs) {
+			return nil, fmt.Errorf("can’t shift %d elements off of a list of length %d",
+				n, len(xs))
+		}
+		return slices.Clip(xs[n:]), nil
+	})
+}
+
+func cmdSignal(c *Call) uint8 {
+	iflag, lflag, rflag := c.Has('i'), c.Has('l'), c.Has('r')
+	switch {
+	case iflag && rflag, lflag && (iflag || rflag):
+		return c.Usage()
+	case !iflag && !rflag:
+		if len(c.Args) > 0 {
+			return c.Usage()
+		}
+		names := make([]string, 0, len(signals))
+		for n := range signals {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		for _, n := range names {
+			if _, ok := c.Sh.funcs[n]; ok && c.Sh.sigs[n] != nil {
+				fmt.Fprintf(c.Stdout, "%s function\n", n)
+			} else if sig := signals[n]; c.Sh.ignored[n] != nil ||
+				signal.Ignored(sig) && signalName(sig.(syscall.Signal)) == n {
+				fmt.Fprintf(c.Stdout, "%s ignored\n", n)
+			}
+		}
+		return 0
+	case len(c.Args) == 0:
+		return c.Usage()
+	}
+
+	names := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		n := strings.ToLower(a)
+		if !strings.HasPrefix(n, "sig") {
+			n = "sig" + n
+		}
+		if _, ok := signals[n]; !ok {
+			return c.Errorf("unknown signal ‘%s’", a)
+		}
+		names[i] = n
+	}
+
+	for _, n := range names {
+		c.Sh.unhandleSignal(n)
+		c.Sh.unignoreSignal(n)
+		if iflag {
+			c.Sh.ignoreSignal(n)
+		}
+	}
+	return 0
+}
+
+func cmdSort(c *Call) uint8 {
+	return modifyVar(c, c.Args[0], func(xs []string) ([]string, error) {
+		xs = slices.Clone(xs)
+		if !c.Has('n') {
+			slices.Sort(xs)
+			return xs, nil
+		}
+
+		ns := make(map[string]float64, len(xs))
+		for _, x := range xs {
+			n, err := strconv.ParseFloat(x, 64)
+			if err != nil {
+				return nil, fmt.Errorf("‘%s’ isn’t a valid number", x)
+			}
+			ns[x] = n
+		}
+		slices.SortStableFunc(xs, func(a, b string) int {
+			return cmp.Compare(ns[a], ns[b])
+		})
+		return xs, nil
+	})
+}
+
+func cmdSplit(c *Call) uint8 {
+	var seps []string
+	for _, f := range c.Flags {
+		if f.Key == 's' {
+			seps = append(seps, f.Value)
+		}
+	}
+	sp, err := newSplitter(c.Flags, seps)
+	switch {
+	case errors.Is(err, errSplitFlags):
+		return c.Usage()
+	case err != nil:
+		return c.Errorf("%s", err)
+	}
+
+	var parts []string
+	for _, s := range c.Args[1:] {
+		sp.Reset()
+		sp.Write([]byte(s))
+		parts = append(parts, sp.Fields()...)
+	}
+
+	ident := c.Args[0]
+	if len(parts) == 0 {
+		err = unsetVar(c.ctx, ident, c.Has('g'))
+	} else {
+		err = setVar(c.ctx, ident, c.Has('g'), parts)
+	}
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	return 0
+}
+
+func cmdTrue(_ *Call) uint8 {
+	return 0
+}
+
+func cmdType(c *Call) uint8 {
+	aflag, sflag := c.Has('a'), c.Has('s')
+	for _, a := range c.Args {
+		var found bool
+		if f, ok := c.Sh.funcs[a]; ok {
+			if sflag {
+				var pr printer
+				pr.function(a, f)
+				io.WriteString(c.Stdout, pr.sb.String())
+			} else if f.pos.file != "" {
+				fmt.Fprintf(c.Stdout, "function %s:%d\n", f.pos.file, f.pos.line)
+			} else {
+				fmt.Fprintln(c.Stdout, "function")
+			}
+			found = true
+		}
+		if _, ok := c.Sh.builtins[a]; ok && (aflag || !found) {
+			fmt.Fprintln(c.Stdout, "builtin")
+			found = true
+		}
+		if aflag {
+			for _, path := range c.Sh.lookPathAll(c.ctx, a) {
+				fmt.Fprintln(c.Stdout, "executable", path)
+				found = true
+			}
+		} else if !found {
+			if path, err := c.Sh.lookPath(c.ctx, a); err == nil {
+				fmt.Fprintln(c.Stdout, "executable", path)
+				found = true
+			}
+		}
+		if !found {
+			fmt.Fprintln(c.Stdout, "unknown")
+		}
+	}
+
+	return 0
+}
+
+func cmdRehash(c *Call) uint8 {
+	c.Sh.hash.clear()
+	return 0
+}
+
+func cmdWhatis(c *Call) uint8 {
+	var failed bool
+	for _, a := range c.Args {
+		var pr printer
+		if f, ok := c.Sh.funcs[a]; ok {
+			pr.function(a, f)
+		}
+		if mv, ok := lookupMap(c.ctx, a); ok {
+			pr.mapVar(a, mv)
+		} else if xs, ok := c.Var(a); ok {
+			pr.variable(a, xs)
+		} else if v, ok := c.Sh.LookupEnv(a); ok {
+			pr.sb.WriteString("set -e " + quoteWord(a) + " " + quoteWord(v) + "\n")
+		}
+
+		if pr.sb.Len() == 0 {
+			c.Errorf("‘%s’ is neither a function nor a variable", a)
+			failed = true
+		}
+		io.WriteString(c.Stdout, pr.sb.String())
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func cmdUniq(c *Call) uint8 {
+	return modifyVar(c, c.Args[0], func(xs []string) ([]string, error) {
+		seen := make(map[string]bool, len(xs))
+		ys := make([]string, 0, len(xs))
+		for _, x := range xs {
+			if !seen[x] {
+				seen[x] = true
+				ys = append(ys, x)
+			}
+		}
+		return ys, nil
+	})
+}
+
+func cmdUmask(c *Call) uint8 {
+	if len(c.Args) == 0 {
+		u := syscall.Umask(022)
+		syscall.Umask(u)
+		fmt.Fprintf(c.Stdout, "%04o\n", u)
+	} else {
+		s := c.Args[0]
+		u, err := strconv.ParseUint(s, 8, 0)
+		switch {
+		case errors.Is(err, strconv.ErrRange), err == nil && u < 0 || u > 0777:
+			c.Errorf("umask ‘%s’ is outside the allowed range of [0, 0777]", s)
+		case errors.Is(err, strconv.ErrSyntax):
+			c.Errorf("‘%s’ isn’t a valid umask", s)
+		}
+		if err != nil {
+			return 1
+		}
+		syscall.Umask(int(u))
+	}
+	return 0
+}
+
+func cmdWait(c *Call) uint8 {
+	if len(c.Args) == 0 {
+		c.Sh.async.wg.Wait()
+	} else {
+		ids := make([]uint64, len(c.Args))
+		for i, a := range c.Args {
+			n, err := strconv.ParseUint(a, 10, 64)
+			if err != nil {
+				return c.Errorf("%s", err)
+			}
+			ids[i] = n
+		}
+
+		for _, id := range ids {
+			c.Sh.async.mtx.Lock()
+			wg, ok := c.Sh.async.wgs[id]
+			c.Sh.async.mtx.Unlock()
+			if ok {
+				wg.Wait()
+			}
+		}
+	}
+	return 0
+}
+
+// lookupScope returns the variables visible in the given context; either the
+// function-local ones or the global ones
+func lookupScope(ctx context, global bool) map[string][]string {
+	if global || ctx.scope == nil {
+		return ctx.sh.vars
+	}
+	return ctx.scope
+}
+
+// modifyVar replaces the value of the variable ident with the result of
+// calling f on it.  The value passed to f may be shared with other scopes, so
+// f must not modify it.
+func modifyVar(c *Call, ident string, f func(xs []string) ([]string, error)) uint8 {
+	gflag := c.Has('g')
+	xs, err := varValue(c.ctx, ident, gflag)
+	if err == nil {
+		xs, err = f(xs)
+	}
+	if err == nil {
+		err = setVar(c.ctx, ident, gflag, xs)
+	}
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	return 0
+}
+
+func checkVarName(ident string) error {
+	if slices.Contains(reservedNames, ident) {
+		return fmt.Errorf("the ‘%s’ variable is read-only", ident)
+	}
+	if ok, r := isRefName(ident); !ok {
+		return fmt.Errorf("rune ‘%c’ is not allowed in variable names", r)
+	}
+	return nil
+}
+
+// setVar sets the variable ident to vals.  If ident refers to the elements of
+// a list such as ‘xs[1..3]’ or an element of a map such as ‘m[key]’, only
+// those elements are set.
+func setVar(ctx context, ident string, global bool, vals []string) error {
+	name, key, isRef := splitMapRef(ident)
+	if err := checkVarName(name); err != nil {
+		return err
+	}
+	if isRef {
+		xs, mv, ok := visibleVar(ctx, name, global)
+		// An undefined variable indexed like a list is an empty one, so
+		// that we don’t make a map out of a mistake like ‘set xs[2] v’
+		if !ok && mv == nil {
+			_, _, res := getIndexRange(key, 0)
+			ok = !cmdFailed(res)
+		}
+		if ok {
+			ys, err := spliceList(xs, key, vals)
+			if err != nil {
+				return err
+			}
+			lookupScope(ctx, global)[name] = ys
+			return nil
+		}
+		setMapKey(ctx, name, key, global, mv, vals)
+		return nil
+	}
+	lookupScope(ctx, global)[name] = vals
+	delete(lookupMaps(ctx, global), name)
+	return nil
+}
+
+func unsetVar(ctx context, ident string, global bool) error {
+	name, key, isRef := splitMapRef(ident)
+	if err := checkVarName(name); err != nil {
+		return err
+	}
+	if isRef {
+		_, mv, ok := visibleVar(ctx, name, global)
+		if ok {
+			return setVar(ctx, ident, global, nil)
+		}
+		unsetMapKey(ctx, name, key, global, mv)
+		return nil
+	}
+	delete(lookupScope(ctx, global), name)
+	delete(lookupMaps(ctx, global), name)
+	return nil
+}
+
+// command returns a copy of the command the builtin was invoked as, with its
+// arguments replaced by args
+func (c *Call) command(args []string) *exec.Cmd {
+	cmd := &exec.Cmd{Path: args[0], Args: args}
+	cmd.Stdin = c.cmd.Stdin
+	cmd.Stdout = c.cmd.Stdout
+	cmd.Stderr = c.cmd.Stderr
+	cmd.ExtraFiles = c.cmd.ExtraFiles
+	cmd.Dir = c.cmd.Dir
+	cmd.Env = c.cmd.Env
+	if cmd.Env == nil {
+		cmd.Env = c.Sh.Environ()
+	}
+	return cmd
+}
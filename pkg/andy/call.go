@@ -0,0 +1,216 @@
+package andy
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+// Unlimited can be used as the MaxArgs of a builtin that accepts any number of
+// arguments
+const Unlimited = -1
+
+// helpFlag is the key of the ‘--help’ flag every builtin accepts.  It is not a
+// valid rune, so it can’t clash with the short flags of a builtin.
+const helpFlag rune = -1
+
+// A Builtin is a command implemented in Go
+type Builtin struct {
+	Name string
+
+	// Usage holds one synopsis per line, such as ‘cd [directory]’
+	Usage []string
+
+	// Flags are parsed from the arguments of the builtin before Run is
+	// called.  If RawArgs is true no flags are parsed and every argument is
+	// passed through as-is.
+	Flags   []Flag
+	RawArgs bool
+
+	// The allowed number of non-flag arguments.  If the builtin is called
+	// with a number of arguments outside of this range, the usage is
+	// printed and Run is not called.
+	MinArgs, MaxArgs int
+
+	Run func(c *Call) uint8
+}
+
+// A Flag describes a single command-line flag of a builtin
+type Flag struct {
+	Short rune
+	Long  string
+	Arg   opts.ArgMode
+	Value string // The name of the argument in the help output
+	Help  string
+}
+
+// A Call is a single invocation of a builtin
+type Call struct {
+	Sh             *Interpreter
+	Name           string
+	Flags          []opts.Flag
+	Args           []string
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+
+	builtin *Builtin
+	cmd     *exec.Cmd
+	ctx     context
+}
+
+func (b *Builtin) call(cmd *exec.Cmd, ctx context) uint8 {
+	c := &Call{
+		Sh:      ctx.sh,
+		Name:    cmd.Args[0],
+		Stdin:   cmd.Stdin,
+		Stdout:  cmd.Stdout,
+		Stderr:  cmd.Stderr,
+		builtin: b,
+		cmd:     cmd,
+		ctx:     ctx,
+	}
+
+	if b.RawArgs {
+		c.Args = cmd.Args[1:]
+		return b.Run(c)
+	}
+
+	flags, rest, err := opts.GetLong(cmd.Args, b.longOpts())
+	if err != nil {
+		c.Errorf("%s", err)
+		return c.Usage()
+	}
+	for _, f := range flags {
+		if f.Key == helpFlag {
+			b.help(c.Stdout)
+			return 0
+		}
+	}
+
+	c.Flags, c.Args = flags, rest
+	if len(rest) < b.MinArgs || b.MaxArgs != Unlimited && len(rest) > b.MaxArgs {
+		return c.Usage()
+	}
+	return b.Run(c)
+}
+
+func (b *Builtin) longOpts() []opts.LongOpt {
+	xs := make([]opts.LongOpt, len(b.Flags), len(b.Flags)+1)
+	for i, f := range b.Flags {
+		xs[i] = opts.LongOpt{Short: f.Short, Long: f.Long, Arg: f.Arg}
+	}
+	return append(xs, opts.LongOpt{Short: helpFlag, Long: "help"})
+}
+
+func (b *Builtin) usage(w io.Writer) {
+	for i, u := range b.Usage {
+		if i == 0 {
+			fmt.Fprintln(w, "Usage:", u)
+		} else {
+			fmt.Fprintln(w, "      ", u)
+		}
+	}
+}
+
+func (b *Builtin) help(w io.Writer) {
+	b.usage(w)
+	if len(b.Flags) == 0 {
+		return
+	}
+
+	xs := make([]string, len(b.Flags))
+	n := 0
+	for i, f := range b.Flags {
+		xs[i] = fmt.Sprintf("-%c, --%s", f.Short, f.Long)
+		switch f.Arg {
+		case opts.Required:
+			xs[i] += "=" + f.Value
+		case opts.Optional:
+			xs[i] += "[=" + f.Value + "]"
+		}
+		n = max(n, len(xs[i]))
+	}
+
+	fmt.Fprintln(w, "\nOptions:")
+	for i, f := range b.Flags {
+		fmt.Fprintf(w, "  %-*s  %s\n", n, xs[i], f.Help)
+	}
+}
+
+// Usage prints the usage of the builtin to standard error and returns the
+// exit code to use for a usage error
+func (c *Call) Usage() uint8 {
+	c.builtin.usage(c.Stderr)
+	return 1
+}
+
+// Errorf prints an error message prefixed with the name of the builtin to
+// standard error and returns the exit code to use for a failure
+func (c *Call) Errorf(format string, args ...any) uint8 {
+	format = fmt.Sprintf("%s: %s\n", c.Name, strings.TrimSuffix(format, "\n"))
+	fmt.Fprintf(c.Stderr, format, args...)
+	return 1
+}
+
+// Flag returns the value of the last occurrence of the flag r, and whether or
+// not it was passed at all
+func (c *Call) Flag(r rune) (string, bool) {
+	for i := len(c.Flags) - 1; i >= 0; i-- {
+		if c.Flags[i].Key == r {
+			return c.Flags[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Has reports whether or not the flag r was passed
+func (c *Call) Has(r rune) bool {
+	_, ok := c.Flag(r)
+	return ok
+}
+
+// Var returns the value of the variable name as visible to the builtin,
+// preferring function-local variables over global ones.  The value of a map
+// is its sorted keys.
+func (c *Call) Var(name string) ([]string, bool) {
+	if xs, ok := c.ctx.scope[name]; ok {
+		return xs, true
+	}
+	if mv, ok := c.ctx.maps[name]; ok {
+		return mv.keys(), true
+	}
+	return c.Sh.Var(name)
+}
+
+// SetVar sets the variable name to vals in the scope of the caller.  Use
+// Interpreter.SetVar to set global variables.
+func (c *Call) SetVar(name string, vals ...string) error {
+	return setVar(c.ctx, name, false, vals)
+}
+
+// Dir returns the working directory the builtin was invoked from
+func (c *Call) Dir() string {
+	return c.ctx.wd.cwd
+}
+
+// RegisterBuiltin makes b callable from Andy code, replacing any existing
+// builtin of the same name
+func (sh *Interpreter) RegisterBuiltin(b *Builtin) {
+	sh.builtins[b.Name] = b
+}
+
+// Builtins returns the builtins available in the interpreter, sorted by name
+func (sh *Interpreter) Builtins() []*Builtin {
+	xs := make([]*Builtin, 0, len(sh.builtins))
+	for _, b := range sh.builtins {
+		xs = append(xs, b)
+	}
+	slices.SortFunc(xs, func(a, b *Builtin) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return xs
+}
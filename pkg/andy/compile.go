@@ -0,0 +1,424 @@
+package andy
+
+import "strings"
+
+// Andy code is compiled to a list of instructions for a stack machine before
+// being run on a vm.  Each body of code — a statement, a function body, a
+// process substitution, or a command in a pipeline — is compiled into its own
+// chunk.  Values are evaluated onto a stack of string lists, and control flow
+// is expressed with jumps on the result of the last command.
+
+type opcode uint8
+
+// Unless noted otherwise, instructions that jump jump to arg
+const (
+	// Values
+	opConst     opcode = iota // Push consts[arg]
+	opTilde                   // Push consts[arg] with a tilde expanded
+	opVar                     // Push the variable named by consts[arg]
+	opVarDyn                  // Pop a name and push its variable, or jump
+	opVarName                 // Check the top of the stack is a name, or jump
+	opVarMap                  // Jump if the top of the stack names a map, or look it up
+	opDefault                 // Pop the top of the stack if empty, or jump
+	opIndex                   // Pop indices and a list and push the elements
+	opMapIndex                // Pop indices and the name of a map and push the elements
+	opFlatten                 // Join the top of the stack with spaces
+	opLength                  // Replace the top of the stack with its length
+	opConcat                  // Pop two lists and push their product
+	opList                    // Pop arg lists and push them joined together
+	opArith                   // Push the result of exprs[arg]
+	opProcSub                 // Pop separators and push chunks[arg] split
+	opProcRead                // Push a pipe from the output of chunks[arg]
+	opProcWrite               // Push a pipe to the input of chunks[arg]
+	opProcRdWr                // Push both of the above
+
+	// Commands
+	opBegin    // Start a command, jumping on failure to evaluate it
+	opSimple   // Pop arg lists and run them as a command
+	opPipeline // Run pipes[arg] as a pipeline
+	opFuncDef  // Pop a name and arguments and define funcs[arg]
+	opSave     // Save the standard streams before redirecting them
+	opRedirect // Pop a filename and apply redirs[arg] to it
+	opRestore  // Close redirected files and restore the standard streams
+	opFor      // Pop values and a binding and start a for-loop over them
+	opNext     // Bind the next value of the innermost for-loop, or jump
+	opEndFor   // Finish the innermost for-loop
+	opDefer    // Run chunks[arg] when the chunk being run finishes
+
+	// Control flow
+	opJump
+	opJumpIfFailed // Jump if the last command failed
+	opJumpIfOK     // Jump if the last command succeeded
+	opJumpIfError  // Jump if the last command had a shell error
+	opSucceed      // Set the result of the last command to success
+)
+
+type instr struct {
+	op  opcode
+	arg int32
+}
+
+// A chunk is a compiled body of code along with the tables its instructions
+// refer to
+type chunk struct {
+	code   []instr
+	consts [][]string
+	chunks []*chunk
+	pipes  [][]*chunk
+	funcs  []function
+	redirs []redirect
+	exprs  []arithExpr
+}
+
+// A redirect is a compiled astRedirect.  If arg is true the file is given as
+// a plain argument, in which case ‘_’ and sockets are handled specially.
+type redirect struct {
+	kind redirKind
+	arg  bool
+}
+
+type compiler struct {
+	c *chunk
+}
+
+func compile(tls []astTopLevel) *chunk {
+	cp := compiler{&chunk{}}
+	cp.patch(cp.body(tls))
+	return cp.c
+}
+
+func compileCommand(cc astCleanCommand) *chunk {
+	cp := compiler{&chunk{}}
+	cp.command(cc)
+	return cp.c
+}
+
+func (cp compiler) emit(op opcode, arg int) int {
+	cp.c.code = append(cp.c.code, instr{op, int32(arg)})
+	return len(cp.c.code) - 1
+}
+
+// patch makes the jumps at the given indices jump to the next instruction
+func (cp compiler) patch(jumps []int) {
+	for _, i := range jumps {
+		cp.c.code[i].arg = int32(len(cp.c.code))
+	}
+}
+
+// body compiles a list of statements, returning the jumps to patch to where
+// execution continues when a statement fails
+func (cp compiler) body(tls []astTopLevel) []int {
+	if len(tls) == 0 {
+		cp.emit(opSucceed, 0)
+		return nil
+	}
+
+	var fails []int
+	for i, tl := range tls {
+		switch tl := tl.(type) {
+		case astFuncDef:
+			cp.funcDef(tl)
+		case astCommandList:
+			cp.cmdList(tl)
+		}
+		if i < len(tls)-1 {
+			fails = append(fails, cp.emit(opJumpIfFailed, 0))
+		}
+	}
+	return fails
+}
+
+func (cp compiler) funcDef(fd astFuncDef) {
+	i := len(cp.c.funcs)
+	cp.c.funcs = append(cp.c.funcs, function{
+		body: fd.body,
+		code: compile(fd.body),
+		pos:  fd.pos,
+	})
+
+	j := cp.emit(opBegin, 0)
+	cp.value(fd.args)
+	cp.emit(opFuncDef, i)
+	cp.patch([]int{j})
+}
+
+func (cp compiler) cmdList(cl astCommandList) {
+	if cl.lhs == nil {
+		cp.pipeline(cl.rhs)
+		return
+	}
+
+	cp.cmdList(*cl.lhs)
+	op := opJumpIfFailed
+	if cl.op == binOr {
+		op = opJumpIfOK
+	}
+	j := cp.emit(op, 0)
+	cp.pipeline(cl.rhs)
+	cp.patch([]int{j})
+}
+
+func (cp compiler) pipeline(pl astPipeline) {
+	if len(pl) == 1 {
+		cp.command(pl[0])
+		return
+	}
+
+	cs := make([]*chunk, len(pl))
+	for i, cc := range pl {
+		cs[i] = compileCommand(cc)
+	}
+	cp.emit(opPipeline, len(cp.c.pipes))
+	cp.c.pipes = append(cp.c.pipes, cs)
+}
+
+func (cp compiler) command(cc astCleanCommand) {
+	// The redirections of deferred code apply when it runs
+	if d, ok := cc.cmd.(*astDefer); ok {
+		body := &astCompound{cmds: d.body, rs: d.rs}
+		cp.emit(opDefer, len(cp.c.chunks))
+		cp.c.chunks = append(cp.c.chunks, compileCommand(astCleanCommand{body, cc.pos}))
+		return
+	}
+
+	rs := cc.cmd.redirs()
+	var fails []int
+	if len(rs) > 0 {
+		cp.emit(opSave, 0)
+		for _, re := range rs {
+			fails = append(fails, cp.emit(opBegin, 0))
+			cp.value(re.file)
+			_, arg := re.file.(astArgument)
+			cp.emit(opRedirect, len(cp.c.redirs))
+			cp.c.redirs = append(cp.c.redirs, redirect{re.kind, arg})
+		}
+	}
+
+	switch cmd := cc.cmd.(type) {
+	case *astSimple:
+		fails = append(fails, cp.emit(opBegin, 0))
+		for _, v := range cmd.args {
+			cp.value(v)
+		}
+		cp.emit(opSimple, len(cmd.args))
+	case *astCompound:
+		fails = append(fails, cp.body(cmd.cmds)...)
+	case *astIf:
+		fails = append(fails, cp.ifCmd(cmd)...)
+	case *astWhile:
+		fails = append(fails, cp.whileCmd(cmd)...)
+	case *astFor:
+		fails = append(fails, cp.forCmd(cmd)...)
+	}
+
+	cp.patch(fails)
+	if len(rs) > 0 {
+		cp.emit(opRestore, 0)
+	}
+}
+
+func (cp compiler) ifCmd(cmd *astIf) []int {
+	cp.cmdList(cmd.cond)
+	ends := []int{cp.emit(opJumpIfError, 0)}
+	j := cp.emit(opJumpIfFailed, 0)
+	ends = append(ends, cp.body(cmd.body)...)
+	ends = append(ends, cp.emit(opJump, 0))
+	cp.patch([]int{j})
+	return append(ends, cp.body(cmd.else_)...)
+}
+
+func (cp compiler) whileCmd(cmd *astWhile) []int {
+	top := len(cp.c.code)
+	cp.cmdList(cmd.cond)
+	ends := []int{cp.emit(opJumpIfError, 0)}
+	done := cp.emit(opJumpIfFailed, 0)
+	ends = append(ends, cp.body(cmd.body)...)
+	ends = append(ends, cp.emit(opJumpIfFailed, 0))
+	cp.emit(opJump, top)
+	cp.patch([]int{done})
+	cp.emit(opSucceed, 0)
+	return ends
+}
+
+func (cp compiler) forCmd(cmd *astFor) []int {
+	ends := []int{cp.emit(opBegin, 0)}
+	cp.value(cmd.bind)
+	cp.value(cmd.vals)
+	cp.emit(opFor, 0)
+
+	top := cp.emit(opNext, 0)
+	exits := cp.body(cmd.body)
+	exits = append(exits, cp.emit(opJumpIfFailed, 0))
+	cp.emit(opJump, top)
+	cp.patch([]int{top})
+	cp.emit(opSucceed, 0)
+	cp.patch(exits)
+	cp.emit(opEndFor, 0)
+	return ends
+}
+
+func (cp compiler) value(v astValue) {
+	if xs, ok := constant(v); ok {
+		cp.constant(opConst, xs)
+		return
+	}
+
+	switch v := v.(type) {
+	case astArgument:
+		cp.constant(opTilde, []string{string(v)})
+	case astConcat:
+		cp.value(v.lhs)
+		cp.value(v.rhs)
+		cp.emit(opConcat, 0)
+	case astList:
+		for _, x := range v {
+			cp.value(x)
+		}
+		cp.emit(opList, len(v))
+	case astVarRef:
+		cp.varRef(v)
+	case astArith:
+		cp.emit(opArith, len(cp.c.exprs))
+		cp.c.exprs = append(cp.c.exprs, v.expr)
+	case astProcSub:
+		cp.value(v.seps)
+		cp.emit(opProcSub, len(cp.c.chunks))
+		cp.c.chunks = append(cp.c.chunks, compile(v.body))
+	case *astProcRedir:
+		op := opProcRdWr
+		switch {
+		case !v.is(procWrite):
+			op = opProcRead
+		case !v.is(procRead):
+			op = opProcWrite
+		}
+		cp.emit(op, len(cp.c.chunks))
+		cp.c.chunks = append(cp.c.chunks, compile(v.body))
+	}
+}
+
+func (cp compiler) varRef(vr astVarRef) {
+	if vr.indices != nil {
+		cp.indexedVarRef(vr)
+		return
+	}
+
+	var end int
+	if xs, ok := constant(vr.ident); ok && len(xs) == 1 {
+		cp.constant(opVar, xs)
+		end = -1
+	} else if vr.ident == nil {
+		cp.constant(opConst, []string{})
+		return
+	} else {
+		cp.value(vr.ident)
+		end = cp.emit(opVarDyn, 0)
+	}
+
+	if vr.repl != nil {
+		j := cp.emit(opDefault, 0)
+		cp.value(vr.repl)
+		cp.patch([]int{j})
+	}
+	cp.varKind(vr.kind)
+
+	if end != -1 {
+		cp.patch([]int{end})
+	}
+}
+
+// indexedVarRef compiles a reference to the elements of a variable, which may
+// be either a list or a map
+func (cp compiler) indexedVarRef(vr astVarRef) {
+	if vr.ident == nil {
+		cp.constant(opConst, []string{})
+		return
+	}
+
+	end := -1
+	if xs, ok := constant(vr.ident); ok && len(xs) == 1 {
+		cp.constant(opConst, xs)
+	} else {
+		cp.value(vr.ident)
+		end = cp.emit(opVarName, 0)
+	}
+
+	isMap := cp.emit(opVarMap, 0)
+	if vr.repl != nil {
+		j := cp.emit(opDefault, 0)
+		cp.value(vr.repl)
+		cp.patch([]int{j})
+	}
+	cp.value(vr.indices)
+	cp.emit(opIndex, 0)
+	done := cp.emit(opJump, 0)
+
+	cp.patch([]int{isMap})
+	cp.value(vr.indices)
+	cp.emit(opMapIndex, 0)
+	cp.patch([]int{done})
+	cp.varKind(vr.kind)
+
+	if end != -1 {
+		cp.patch([]int{end})
+	}
+}
+
+func (cp compiler) varKind(kind varRefKind) {
+	switch kind {
+	case vrFlatten:
+		cp.emit(opFlatten, 0)
+	case vrLength:
+		cp.emit(opLength, 0)
+	}
+}
+
+func (cp compiler) constant(op opcode, xs []string) {
+	cp.emit(op, len(cp.c.consts))
+	cp.c.consts = append(cp.c.consts, xs)
+}
+
+// constant returns the value of v if it can be known without running any
+// code
+func constant(v astValue) ([]string, bool) {
+	switch v := v.(type) {
+	case astArgument:
+		if strings.HasPrefix(string(v), "~") {
+			return nil, false
+		}
+		return []string{string(v)}, true
+	case astString:
+		return []string{string(v)}, true
+	case astTilde:
+		return []string{"~"}, true
+	case astConcat:
+		xs, ok1 := constant(v.lhs)
+		ys, ok2 := constant(v.rhs)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return product(xs, ys), true
+	case astList:
+		xs := make([]string, 0, len(v))
+		for _, x := range v {
+			ys, ok := constant(x)
+			if !ok {
+				return nil, false
+			}
+			xs = append(xs, ys...)
+		}
+		return xs, true
+	}
+	return nil, false
+}
+
+// product returns the Cartesian product of two lists
+func product(xs, ys []string) []string {
+	zs := make([]string, 0, len(xs)*len(ys))
+	for _, x := range xs {
+		for _, y := range ys {
+			zs = append(zs, x+y)
+		}
+	}
+	return zs
+}
@@ -0,0 +1,175 @@
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const cmdFailCode = math.MaxUint8
+
+// A commandResult is the result of running a command.  Its status is what
+// $status is set to after the command; exit codes for successful commands
+// and commands that exit normally, or a short message for anything else.
+type commandResult interface {
+	error
+	ExitCode() uint8
+	Status() string
+}
+
+type errFileOp struct {
+	desc string
+	file string
+	err  error
+}
+
+func (e errFileOp) Error() string {
+	return fmt.Sprintf("Failed to %s file ‘%s’: %s", e.desc, e.file, e.err)
+}
+
+type errClobber struct {
+	file string
+}
+
+func (e errClobber) Error() string {
+	return fmt.Sprintf("Won’t clobber file ‘%s’; did you mean to use ‘>!’?",
+		e.file)
+}
+
+type errExitCode uint8
+
+func (e errExitCode) Error() string {
+	return fmt.Sprintf("exit status %d", uint8(e))
+}
+
+// errExit is the result of code stopped by ‘exit’.  It counts as a failure
+// whatever its exit code, so that nothing runs after it.
+type errExit uint8
+
+func (e errExit) Error() string {
+	return fmt.Sprintf("exit status %d", uint8(e))
+}
+
+// errSignal is the result of a process killed by a signal
+type errSignal struct {
+	sig  syscall.Signal
+	core bool
+}
+
+func (e errSignal) Error() string {
+	return fmt.Sprintf("killed by %s", e.Status())
+}
+
+// message returns a description of the signal in the style of other shells,
+// such as ‘Segmentation fault (core dumped)’
+func (e errSignal) message() string {
+	s := e.sig.String()
+	s = strings.ToUpper(s[:1]) + s[1:]
+	if e.core {
+		s += " (core dumped)"
+	}
+	return s
+}
+
+// errInterrupted is the result of code stopped by Interpreter.Interrupt()
+var errInterrupted = errSignal{sig: syscall.SIGINT}
+
+type errInternal struct {
+	e error
+}
+
+func (e errInternal) Error() string {
+	return e.e.Error()
+}
+
+type errExpected struct {
+	want, got any
+}
+
+func (e errExpected) Error() string {
+	return fmt.Sprintf("Expected %s but got %s", e.want, e.got)
+}
+
+// errSyntax is an error at a known position in the source code
+type errSyntax struct {
+	pos position
+	err error
+}
+
+func (e errSyntax) Error() string {
+	return fmt.Sprintf("%s: %s", e.pos, e.err)
+}
+
+func (e errSyntax) Unwrap() error {
+	return e.err
+}
+
+type errUnsupported string
+
+func (e errUnsupported) Error() string {
+	return fmt.Sprintf("Attempt to %s is unsupported", string(e))
+}
+
+type errInvalidIndex struct {
+	i, l int
+}
+
+func (e errInvalidIndex) Error() string {
+	return fmt.Sprintf("invalid index ‘%d’ into list of length %d", e.i, e.l)
+}
+
+func (e errClobber) ExitCode() uint8      { return cmdFailCode }
+func (e errExpected) ExitCode() uint8     { return cmdFailCode }
+func (e errFileOp) ExitCode() uint8       { return cmdFailCode }
+func (e errInternal) ExitCode() uint8     { return cmdFailCode }
+func (e errUnsupported) ExitCode() uint8  { return cmdFailCode }
+func (e errInvalidIndex) ExitCode() uint8 { return cmdFailCode }
+func (e errExitCode) ExitCode() uint8     { return uint8(e) }
+func (e errExit) ExitCode() uint8         { return uint8(e) }
+func (e errSignal) ExitCode() uint8       { return 128 + uint8(e.sig) }
+
+func (e errClobber) Status() string      { return "clobber:" + e.file }
+func (e errExpected) Status() string     { return fmt.Sprintf("expected:%s", e.want) }
+func (e errFileOp) Status() string       { return e.desc + ":" + e.file }
+func (e errUnsupported) Status() string  { return "unsupported" }
+func (e errInvalidIndex) Status() string { return "index:" + strconv.Itoa(e.i) }
+func (e errExitCode) Status() string     { return strconv.Itoa(int(e)) }
+func (e errExit) Status() string         { return strconv.Itoa(int(e)) }
+
+func (e errInternal) Status() string {
+	var ee *exec.Error
+	if errors.As(e.e, &ee) {
+		return ee.Name + ":" + ee.Err.Error()
+	}
+	return e.e.Error()
+}
+
+func (e errSignal) Status() string {
+	s := signalName(e.sig)
+	if e.core {
+		s += "+core"
+	}
+	return s
+}
+
+type shellError interface {
+	isShellError()
+}
+
+func (_ errClobber) isShellError()      {}
+func (_ errExpected) isShellError()     {}
+func (_ errFileOp) isShellError()       {}
+func (_ errInternal) isShellError()     {}
+func (_ errUnsupported) isShellError()  {}
+func (_ errInvalidIndex) isShellError() {}
+
+func cmdFailed(e commandResult) bool {
+	if _, ok := e.(errExit); ok {
+		return true
+	}
+	return e != nil && e.ExitCode() != 0
+}
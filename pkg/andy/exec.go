@@ -0,0 +1,432 @@
+package andy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// defineFunc defines the function f with the name and arguments in args
+func defineFunc(f function, args []string, ctx context) commandResult {
+	if len(args) == 0 {
+		return errInternal{errors.New("attempted to define function without a name")}
+	}
+
+	n := args[0]
+	f.args = args[1:]
+	ctx.sh.funcs[n] = f
+
+	if sig, ok := signals[n]; ok {
+		// Signals that exit the shell as soon as they arrive need to be
+		// queued for their function instead
+		if _, ok := ctx.sh.sigs[n]; !ok || slices.Contains(exitSignals, n) {
+			ctx.sh.handleSignal(n, sig)
+		}
+	}
+	if n == "sigexit" {
+		for _, n := range fatalSignals {
+			if _, ok := ctx.sh.sigs[n]; !ok && ctx.sh.ignored[n] == nil {
+				ctx.sh.handleSignal(n, signals[n])
+			}
+		}
+	}
+	return errExitCode(0)
+}
+
+// fatalSignals are the signals that would kill the shell without giving
+// ‘sigexit’ a chance to run, so we handle them once it is defined
+var fatalSignals = []string{"sighup", "sigint", "sigterm"}
+
+// exitSignals are the fatal signals that exit the shell as soon as they
+// arrive if they have no function of their own, as the next point where it’s
+// safe to run a handler may never come if the shell is blocked waiting for
+// input.  SIGINT isn’t one of them, as interactive shells ignore it and the
+// terminal sends it to the commands we’re waiting for as well.
+var exitSignals = []string{"sighup", "sigterm"}
+
+// handleSignal queues the signal n to be handled by its function whenever
+// sig is received.  Handlers don’t run as soon as a signal arrives, but at the
+// next point where it’s safe to do so; see dispatchSignals().
+func (sh *Interpreter) handleSignal(n string, sig os.Signal) {
+	_, ok := sh.funcs[n]
+	exit := !ok && slices.Contains(exitSignals, n)
+
+	// Stop the old channel only after registering the new one, so that the
+	// signal doesn’t get its default action in between
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	sh.stopSignal(n)
+	sh.unignoreSignal(n)
+	sh.sigs[n] = ch
+	go func() {
+		for range ch {
+			if exit {
+				sh.exitOnSignal(n)
+				continue
+			}
+			// If the queue is full the signal is lost, just like a signal
+			// that arrives while the same signal is already pending
+			select {
+			case sh.pending <- n:
+			default:
+			}
+		}
+	}()
+}
+
+// exitOnSignal exits the shell with the status of the fatal signal n
+func (sh *Interpreter) exitOnSignal(n string) {
+	sh.exitShell(128 + uint8(signals[n].(syscall.Signal)))
+}
+
+// exitShell runs the exit hook and exits the shell with the given code.  The
+// code being run stops at its next command, as Exit may return or not be set
+// at all.
+func (sh *Interpreter) exitShell(code uint8) commandResult {
+	sh.RunExitHook()
+	if sh.Exit != nil {
+		sh.Exit(int(code))
+	}
+	sh.exit.set(code)
+	return errExit(code)
+}
+
+// dispatchSignals runs the handlers of the signals received since it was last
+// called.  It is called between commands and while waiting for external
+// commands to finish, but only in the foreground.  If a handler fails, its
+// result is returned so that it can become the result of the interrupted
+// command.
+func (sh *Interpreter) dispatchSignals(ctx context) commandResult {
+	if !ctx.fg {
+		return nil
+	}
+	for {
+		select {
+		case n := <-sh.pending:
+			if res := sh.runHandler(n, ctx); cmdFailed(res) {
+				return res
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// runHandler runs the function handling the signal n in the scope of the code
+// it interrupted, passing it the name of the signal as its argument.  Output
+// goes to the standard streams of the interpreter and not to wherever the
+// interrupted command was redirected.  Fatal signals without a handler exit
+// the shell.
+func (sh *Interpreter) runHandler(n string, ctx context) commandResult {
+	f, ok := sh.funcs[n]
+	switch {
+	case ok:
+		top := sh.newContext()
+		ctx.in, ctx.out, ctx.err = top.in, top.out, top.err
+		return callFunc(f, []string{n}, ctx)
+	case n == "sigint" && sh.Interactive:
+		// Interactive shells are interrupted with Interpreter.Interrupt()
+	case slices.Contains(fatalSignals, n):
+		return sh.exitShell(128 + uint8(signals[n].(syscall.Signal)))
+	}
+	return nil
+}
+
+// ignoreSignal ignores the signal n by receiving and discarding it.  Unlike
+// signal.Ignore() this doesn’t stop the program we’re embedded in from
+// receiving it too.
+func (sh *Interpreter) ignoreSignal(n string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals[n])
+	sh.ignored[n] = ch
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+// unignoreSignal stops ignoring the signal n, if it is being ignored.  If
+// nothing else is handling it, it gets its default behavior back.
+func (sh *Interpreter) unignoreSignal(n string) {
+	if ch, ok := sh.ignored[n]; ok {
+		signal.Stop(ch)
+		close(ch)
+		delete(sh.ignored, n)
+	}
+}
+
+// unhandleSignal removes the function n handling a signal, if there is one
+func (sh *Interpreter) unhandleSignal(n string) {
+	sh.stopSignal(n)
+	delete(sh.funcs, n)
+}
+
+// stopSignal stops queueing the signal n, if it is being queued
+func (sh *Interpreter) stopSignal(n string) {
+	if ch, ok := sh.sigs[n]; ok {
+		signal.Stop(ch)
+		close(ch)
+		delete(sh.sigs, n)
+	}
+}
+
+func execPipeline(cs []*chunk, ctx context) commandResult {
+	n := len(cs)
+	ctxs := make([]context, n)
+	files := make([][]io.Closer, n)
+
+	for i := range ctxs {
+		ctxs[i] = ctx
+	}
+
+	for i := range cs[:n-1] {
+		r, w, err := os.Pipe()
+		if err != nil {
+			for _, fs := range files {
+				closeAll(fs)
+			}
+			return errInternal{err}
+		}
+
+		ctxs[i].out = w
+		files[i] = append(files[i], w)
+		ctxs[i+1].in = r
+		files[i+1] = append(files[i+1], r)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n - 1)
+
+	// TODO: Go 1.22 fixed for-loops
+	for i := range cs[:n-1] {
+		ctxs[i].wd = ctxs[i].wd.fork()
+		ctxs[i].exit = ctxs[i].exit.fork()
+		ctxs[i].fg = false
+		go func(c *chunk, ctx context, files []io.Closer) {
+			run(c, ctx)
+			closeAll(files)
+			wg.Done()
+		}(cs[i], ctxs[i], files[i])
+	}
+
+	res := run(cs[n-1], ctxs[n-1])
+	closeAll(files[n-1])
+	if cmdFailed(res) {
+		return res
+	}
+	wg.Wait()
+
+	return errExitCode(0)
+}
+
+func closeAll(xs []io.Closer) {
+	for _, x := range xs {
+		x.Close()
+	}
+}
+
+// openRedirect opens the file named by ss for the redirect re, and redirects
+// the standard input or output of ctx to it
+func openRedirect(re redirect, ss []string, ctx *context) (io.Closer, commandResult) {
+	if len(ss) != 1 {
+		return nil, errExpected{
+			want: "filename",
+			got:  fmt.Sprintf("%d filesnames", len(ss)),
+		}
+	}
+	name := ss[0]
+	path := ctx.resolve(name)
+
+	if re.arg {
+		switch {
+		case re.kind == redirRead && name == "_":
+			path = os.DevNull
+		case re.kind == redirWrite && name == "_":
+			re.kind = redirClob
+			path = os.DevNull
+		case re.kind == redirRead:
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				return nil, errInternal{err}
+			case err == nil && info.Mode()&os.ModeSocket != 0:
+				re.kind = redirSockRead
+			}
+		case re.kind == redirWrite:
+			info, err := os.Stat(path)
+			switch {
+			case err != nil && !errors.Is(err, os.ErrNotExist):
+				return nil, errInternal{err}
+			case err == nil && info.Mode()&os.ModeSocket != 0:
+				re.kind = redirSockWrite
+			case err == nil && !info.Mode().IsRegular():
+				re.kind = redirClob
+			}
+		}
+	}
+
+	var f io.ReadWriteCloser
+	var err error
+	switch re.kind {
+	case redirAppend:
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	case redirClob:
+		f, err = os.Create(path)
+	case redirRead:
+		f, err = os.Open(path)
+	case redirWrite:
+		_, err := os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			f, err = os.Create(path)
+		case err != nil:
+			return nil, errFileOp{"stat", name, err}
+		default: // File exists
+			return nil, errClobber{name}
+		}
+	case redirSockRead, redirSockWrite:
+		f, err = net.Dial("unix", path)
+	}
+	if err != nil {
+		return nil, errInternal{err}
+	}
+
+	switch re.kind {
+	case redirAppend, redirClob, redirWrite, redirSockWrite:
+		ctx.out = f
+	case redirRead, redirSockRead:
+		ctx.in = f
+	}
+	return f, nil
+}
+
+// execArgs runs the simple command args.  The files of any process
+// redirections in the arguments are passed on to external commands.
+func execArgs(args []string, extras []*os.File, ctx context) commandResult {
+	// You might try to run the empty list
+	if len(args) == 0 {
+		return errExitCode(0)
+	}
+
+	// Functions are by far the most common commands in scripts that loop, so
+	// don’t bother creating a command for them
+	if f, ok := ctx.sh.funcs[args[0]]; ok {
+		return callFunc(f, args[1:], ctx)
+	}
+
+	c := &exec.Cmd{Path: args[0], Args: args}
+	c.Stdin, c.Stdout, c.Stderr = ctx.in, ctx.out, ctx.err
+	c.Dir = ctx.wd.cwd
+
+	if len(extras) > 0 {
+		maxFd := slices.MaxFunc(extras, func(a, b *os.File) int {
+			return cmp.Compare(a.Fd(), b.Fd())
+		}).Fd()
+		c.ExtraFiles = make([]*os.File, maxFd)
+		for _, e := range extras {
+			c.ExtraFiles[e.Fd()-3] = e
+		}
+	}
+
+	return execPreparedCommand(c, ctx)
+}
+
+func callFunc(f function, args []string, ctx context) commandResult {
+	if ctx.scope = maps.Clone(ctx.scope); ctx.scope == nil {
+		ctx.scope = map[string][]string{}
+	}
+	ctx.maps = shareMaps(ctx.maps)
+	for i, a := range f.args {
+		if i >= len(args) {
+			break
+		}
+		ctx.scope[a] = []string{args[i]}
+	}
+	if len(args) > len(f.args) {
+		ctx.scope["_"] = args[len(f.args):]
+	} else {
+		ctx.scope["_"] = []string{}
+	}
+	return run(f.code, ctx)
+}
+
+func execPreparedCommand(cmd *exec.Cmd, ctx context) commandResult {
+	if f, ok := ctx.sh.funcs[cmd.Args[0]]; ok {
+		return callFunc(f, cmd.Args[1:], ctx)
+	}
+	if b, ok := ctx.sh.builtins[cmd.Args[0]]; ok {
+		return errExitCode(b.call(cmd, ctx))
+	}
+
+	path, err := ctx.sh.lookPath(ctx, cmd.Args[0])
+	if err != nil {
+		return errInternal{err}
+	}
+	cmd.Path = path
+	if cmd.Env == nil {
+		cmd.Env = ctx.sh.Environ()
+	}
+	if err := cmd.Start(); err != nil {
+		return errInternal{err}
+	}
+	ctx.sh.procs.add(cmd.Process)
+	res, err := waitCommand(cmd, ctx)
+	ctx.sh.procs.remove(cmd.Process)
+	if res != nil {
+		return res
+	}
+
+	switch err := err.(type) {
+	case nil:
+		return errExitCode(0)
+	case *exec.ExitError:
+		ws, ok := err.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() {
+			res := errSignal{ws.Signal(), ws.CoreDump()}
+			// Like other shells, don’t bother reporting signals that were
+			// most likely sent on purpose
+			if ctx.sh.Interactive && res.sig != syscall.SIGINT && res.sig != syscall.SIGPIPE {
+				fmt.Fprintln(ctx.sh.writers.locked(ctx.sh.Stderr), res.message())
+			}
+			return res
+		}
+		return errExitCode(err.ExitCode())
+	default:
+		return errInternal{err}
+	}
+}
+
+// waitCommand waits for the started command cmd to finish, handling signals
+// received in the meantime if ctx is in the foreground.  If a signal handler
+// fails, its result is returned along with the error of the command.
+func waitCommand(cmd *exec.Cmd, ctx context) (commandResult, error) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// Receiving from a nil channel blocks forever
+	var pending chan string
+	if ctx.fg {
+		pending = ctx.sh.pending
+	}
+
+	var res commandResult
+	for {
+		select {
+		case err := <-done:
+			return res, err
+		case n := <-pending:
+			if r := ctx.sh.runHandler(n, ctx); cmdFailed(r) && res == nil {
+				res = r
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package andy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// compileGlob returns a regular expression matching the same strings as the
+// glob pattern.  Unlike path.Match, ‘*’ and ‘?’ match any character including
+// ‘/’, as patterns are matched against strings instead of paths.  Character
+// classes may be negated with either ‘!’ or ‘^’, and a backslash matches the
+// character after it literally.
+func compileGlob(pattern string, fold bool) (*regexp.Regexp, error) {
+	sb := strings.Builder{}
+	if fold {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^(?s:")
+
+	rs := []rune(pattern)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteByte('.')
+		case '\\':
+			if i++; i == len(rs) {
+				return nil, fmt.Errorf("trailing backslash in pattern ‘%s’", pattern)
+			}
+			sb.WriteString(regexp.QuoteMeta(string(rs[i])))
+		case '[':
+			j := i + 1
+			if j < len(rs) && (rs[j] == '!' || rs[j] == '^') {
+				j++
+			}
+			if j < len(rs) && rs[j] == ']' {
+				j++
+			}
+			for j < len(rs) && rs[j] != ']' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated character class in pattern ‘%s’",
+					pattern)
+			}
+
+			sb.WriteByte('[')
+			class := rs[i+1 : j]
+			if class[0] == '!' || class[0] == '^' {
+				sb.WriteByte('^')
+				class = class[1:]
+			}
+			for _, r := range class {
+				if r == '\\' || r == '[' || r == ']' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteRune(r)
+			}
+			sb.WriteByte(']')
+			i = j
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	sb.WriteString(")$")
+	return regexp.Compile(sb.String())
+}
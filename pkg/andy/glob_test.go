@@ -0,0 +1,39 @@
+package andy
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		fold, want bool
+	}{
+		{"*.go", "a/b.go", false, true},
+		{"?", "é", false, true},
+		{"a[bc]d", "acd", false, true},
+		{"a[!bc]d", "acd", false, false},
+		{"a[^bc]d", "aed", false, true},
+		{"[]]", "]", false, true},
+		{`\*`, "*", false, true},
+		{`\*`, "x", false, false},
+		{"a.c", "abc", false, false},
+		{"ABC", "abc", true, true},
+		{"a*", "a\nb", false, true},
+	} {
+		re, err := compileGlob(tc.pattern, tc.fold)
+		if err != nil {
+			t.Fatalf("Failed to compile ‘%s’: %s", tc.pattern, err)
+		}
+		if got := re.MatchString(tc.s); got != tc.want {
+			t.Fatalf("Expected ‘%s’ matching ‘%s’ to be %t", tc.pattern, tc.s, tc.want)
+		}
+	}
+
+	for pattern, want := range map[string]string{
+		`a\`:   "trailing backslash in pattern ‘a\\’",
+		"a[bc": "unterminated character class in pattern ‘a[bc’",
+	} {
+		if _, err := compileGlob(pattern, false); err == nil || err.Error() != want {
+			t.Fatalf("Expected ‘%s’ to fail with ‘%s’ but got ‘%v’", pattern, want, err)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package andy
 
 import "unicode"
 
@@ -52,6 +52,7 @@ func isRedirTok(k tokenKind) bool {
 
 func isValueTok(k tokenKind) bool {
 	return k == tokArg ||
+		k == tokArith ||
 		k == tokConcat ||
 		k == tokParenOpen ||
 		k == tokProcRdWr ||
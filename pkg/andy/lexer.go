@@ -1,8 +1,9 @@
-package main
+package andy
 
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -38,32 +39,79 @@ const (
 
 type lexer struct {
 	input string
-	out   chan token
+	file  string
+	state lexFn
 	pos   int
 	start int
+	begin int // Start of the current token, used for source positions
 	width int
+	lines []int // Offsets of the start of each line
 	s     stack.Stack[nestState]
+
+	// Tokens that have been lexed but not yet consumed by the parser
+	toks []token
+	head int
+
+	// Comments are not emitted as tokens, but are recorded for the
+	// formatter
+	comments []comment
+}
+
+// A comment is a single comment in the source code, including the leading ‘#’
+type comment struct {
+	pos    position
+	text   string
+	inList bool
 }
 
 type lexFn func(*lexer) lexFn
 
 func newLexer(s string) lexer {
+	lines := make([]int, 1, 64)
+	for i, b := range []byte(s) {
+		if b == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
 	return lexer{
 		input: s,
-		out:   make(chan token),
+		state: lexDefault,
+		lines: lines,
 		s:     stack.New[nestState](4),
+		toks:  make([]token, 0, 8),
 	}
 }
 
-func (l *lexer) run() {
-	for state := lexDefault; state != nil; {
-		state = state(l)
+// token returns the next token of the input, running the state functions of
+// the lexer until one has been emitted.  Once the lexer has stopped, it
+// returns false.
+func (l *lexer) token() (token, bool) {
+	for l.head == len(l.toks) {
+		if l.state == nil {
+			return token{}, false
+		}
+		l.toks, l.head = l.toks[:0], 0
+		l.state = l.state(l)
 	}
-	close(l.out)
+	t := l.toks[l.head]
+	l.head++
+	return t, true
 }
 
 func (l *lexer) emit(t tokenKind) {
-	l.out <- token{t, l.input[l.start:l.pos]}
+	l.emitVal(t, l.input[l.start:l.pos])
+}
+
+func (l *lexer) emitVal(t tokenKind, s string) {
+	l.toks = append(l.toks, token{kind: t, val: s, pos: l.position(l.begin)})
+}
+
+func (l *lexer) position(off int) position {
+	i, ok := slices.BinarySearch(l.lines, off)
+	if !ok {
+		i--
+	}
+	return position{l.file, i + 1, off - l.lines[i] + 1}
 }
 
 func (l *lexer) next() rune {
@@ -98,15 +146,13 @@ func (l *lexer) acceptRun(r rune) int {
 }
 
 func (l *lexer) errorf(format string, args ...any) lexFn {
-	l.out <- token{
-		kind: tokError,
-		val:  fmt.Sprintf(format, args...),
-	}
+	l.emitVal(tokError, fmt.Sprintf(format, args...))
 	return nil
 }
 
 func lexDefault(l *lexer) lexFn {
 	for {
+		l.begin = l.pos
 		switch r := l.next(); {
 		case isEol(r):
 			if l.s.TopIs(inBraceless) {
@@ -241,9 +287,17 @@ func lexDefault(l *lexer) lexFn {
 }
 
 func skipComment(l *lexer) lexFn {
+	start := l.pos - 1
 	if i := strings.IndexByte(l.input[l.pos:], '\n'); i != -1 {
 		l.pos += i
+	} else {
+		l.pos = len(l.input)
 	}
+	l.comments = append(l.comments, comment{
+		pos:    l.position(start),
+		text:   strings.TrimRightFunc(l.input[start:l.pos], unicode.IsSpace),
+		inList: l.s.TopIs(inParens),
+	})
 	return lexDefault
 }
 
@@ -272,7 +326,7 @@ func lexArg(l *lexer) lexFn {
 			r == ')' && inState(l.s, inParens),
 			r == '}' && inState(l.s, inBraces):
 			l.backup()
-			l.out <- token{tokArg, sb.String()}
+			l.emitVal(tokArg, sb.String())
 			return lexDefault
 		case r == '&':
 			if l.peek() != '&' {
@@ -285,10 +339,10 @@ func lexArg(l *lexer) lexFn {
 			isEol(r),
 			isMetachar(r) && r != '{':
 			l.backup()
-			l.out <- token{tokArg, sb.String()}
+			l.emitVal(tokArg, sb.String())
 			return lexMaybeConcat
 		case r == ':' && l.s.TopIs(inParens, afterDollar):
-			l.out <- token{tokArg, sb.String()}
+			l.emitVal(tokArg, sb.String())
 			l.emit(tokColon)
 			return lexDefault
 		default:
@@ -299,6 +353,9 @@ func lexArg(l *lexer) lexFn {
 
 func lexVarRef(l *lexer) lexFn {
 	l.next() // Consume ‘$’
+	if l.peek() == '[' {
+		return lexArith
+	}
 
 	// Flat or not?
 	kind := tokVarRef
@@ -316,13 +373,13 @@ func lexVarRef(l *lexer) lexFn {
 		kind = tokVarLen
 		l.next()
 	case r != '(' && !isRefRune(r):
-		l.out <- token{tokArg, "$"}
+		l.emitVal(tokArg, "$")
 		return lexMaybeConcat
 	}
 
 	if l.peek() == '(' {
 		l.next()
-		l.out <- token{kind, ""}
+		l.emitVal(kind, "")
 		l.emit(tokParenOpen)
 		l.s.Push(afterDollar)
 		l.s.Push(inParens)
@@ -353,6 +410,32 @@ func lexVarRef(l *lexer) lexFn {
 	return lexMaybeConcat
 }
 
+// lexArith lexes the expression of an arithmetic expansion, which is parsed
+// separately by parseArith()
+func lexArith(l *lexer) lexFn {
+	l.next() // Consume ‘[’
+	l.start = l.pos
+	for depth := 1; depth > 0; {
+		switch l.next() {
+		case eof:
+			return l.errorf("unterminated arithmetic expansion")
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+	}
+	l.emitVal(tokArith, l.input[l.start:l.pos-1])
+
+	switch {
+	case l.s.TopIs(inBraces):
+		return lexDefault
+	case l.s.TopIs(inQuotes):
+		return lexStringDouble
+	}
+	return lexMaybeConcat
+}
+
 func lexStringRaw(l *lexer) lexFn {
 	l.next() // Consume ‘r’
 	n := l.acceptRun('#')
@@ -424,7 +507,7 @@ func lexStringDouble(l *lexer) lexFn {
 			l.s.Push(inQuotes)
 			fallthrough
 		case '"':
-			l.out <- token{tokString, sb.String()}
+			l.emitVal(tokString, sb.String())
 			return lexMaybeConcat
 		default:
 			sb.WriteRune(r)
@@ -446,7 +529,7 @@ func lexBacktick(l *lexer) lexFn {
 		l.emit(tokProcSub)
 		l.emit(tokParenOpen)
 	case unicode.IsSpace(r):
-		l.out <- token{tokArg, "`"}
+		l.emitVal(tokArg, "`")
 	default:
 		l.s.Push(inBraceless)
 		l.emit(tokProcSub)
@@ -466,6 +549,7 @@ func lexMaybeConcat(l *lexer) lexFn {
 	}
 
 	l.emit(tokConcat)
+	l.begin = l.pos
 	switch r := l.peek(); {
 	case r == '`':
 		return lexBacktick
@@ -1,6 +1,9 @@
-package main
+package andy
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 // BEGIN TESTING LEXER OBJECT
 
@@ -51,10 +54,8 @@ func TestPeek(t *testing.T) {
 
 func getTokens(s string) []tokenKind {
 	l := newLexer(s)
-	go l.run()
-
 	xs := []tokenKind{}
-	for t := range l.out {
+	for t, ok := l.token(); ok; t, ok = l.token() {
 		xs = append(xs, t.kind)
 	}
 	return xs
@@ -144,6 +145,18 @@ func TestLexProcSub(t *testing.T) {
 	assertTokens(t, xs, getTokens(s))
 }
 
+func TestLexArith(t *testing.T) {
+	xs := []tokenKind{
+		tokArg, tokArith, tokArg, tokConcat, tokArith, tokConcat, tokArg,
+		tokString, tokConcat, tokArith, tokConcat, tokString, tokEndStmt,
+		tokArg, tokError,
+	}
+	s := `echo $[1 + 2] x$[$xs[0]]y "a$[i]b"
+echo $[1`
+
+	assertTokens(t, xs, getTokens(s))
+}
+
 func TestLexList(t *testing.T) {
 	xs := []tokenKind{
 		tokEndStmt, tokParenOpen, tokEndStmt, tokArg, tokEndStmt,
@@ -170,3 +183,31 @@ func TestLexList(t *testing.T) {
 
 	assertTokens(t, xs, getTokens(s))
 }
+
+// A script of a few thousand lines exercising most of the syntax
+var largeScript = strings.Repeat(`
+# Build a list of files and process them
+func process file {
+	set base `+"`"+`{basename $file .c}
+	if test -f $base.o && ! test $base.o -nt $file {
+		echo skipping $base
+	} else {
+		cc -c -o $base.o $file >>build.log || echo "failed to build ‘$file’"
+	}
+}
+
+set files *.c $(extra:none) (a b c).c
+for f in $files[1..] {
+	process $f | tee -a <{cat log} >_
+}
+while read -d: line <input {
+	echo $line | tr a-z A-Z; echo $#files $^files
+}
+`, 200)
+
+func BenchmarkLexer(b *testing.B) {
+	b.SetBytes(int64(len(largeScript)))
+	for i := 0; i < b.N; i++ {
+		getTokens(largeScript)
+	}
+}
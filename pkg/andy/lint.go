@@ -0,0 +1,534 @@
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+// A Diagnostic is a likely bug found by Lint
+type Diagnostic struct {
+	File      string
+	Line, Col int
+	Message   string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", position{d.File, d.Line, d.Col}, d.Message)
+}
+
+// Variables that are set by the shell itself
+var predefinedVars = append([]string{"_", "args"}, reservedNames...)
+
+type linter struct {
+	diags []Diagnostic
+
+	// Variables set and functions defined anywhere in the script.  If
+	// dynamic is true the script sets variables whose names we can’t know,
+	// so we can’t tell if a variable is never set.
+	vars, funcs map[string]bool
+	dynamic     bool
+
+	// Functions defined at the top-level, and those defined so far while
+	// walking the top-level
+	topFuncs, defined map[string]bool
+
+	inFunc, inLoop int
+}
+
+// Lint parses the Andy source code in src and reports likely bugs.  Syntax
+// errors are reported as diagnostics too.  The name of the file is used in
+// the diagnostics.
+func Lint(name, src string) []Diagnostic {
+	prog, _, err := parse(name, src)
+	if err != nil {
+		var e errSyntax
+		if errors.As(err, &e) {
+			return []Diagnostic{{name, e.pos.line, e.pos.col, e.err.Error()}}
+		}
+		return []Diagnostic{{name, 1, 1, err.Error()}}
+	}
+
+	l := linter{
+		vars:     make(map[string]bool),
+		funcs:    make(map[string]bool),
+		topFuncs: make(map[string]bool),
+		defined:  make(map[string]bool),
+	}
+	for _, tl := range prog {
+		if fd, ok := tl.(astFuncDef); ok {
+			if xs, ok := staticValues(fd.args[:1]); ok {
+				l.topFuncs[xs[0]] = true
+			}
+		}
+	}
+	inspect(prog, l.collect)
+	l.body(prog, nil)
+
+	slices.SortStableFunc(l.diags, func(a, b Diagnostic) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Col - b.Col
+	})
+	return l.diags
+}
+
+func (l *linter) report(pos position, format string, args ...any) {
+	l.diags = append(l.diags, Diagnostic{
+		File:    pos.file,
+		Line:    pos.line,
+		Col:     pos.col,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// collect records the variables and functions defined by n
+func (l *linter) collect(n any) {
+	switch n := n.(type) {
+	case astFuncDef:
+		xs, ok := staticValues(n.args)
+		if !ok {
+			l.dynamic = true
+			return
+		}
+		l.funcs[xs[0]] = true
+		for _, x := range xs[1:] {
+			l.vars[x] = true
+		}
+	case astCleanCommand:
+		switch cmd := n.cmd.(type) {
+		case *astFor:
+			if xs, ok := staticValues([]astValue{cmd.bind}); ok && len(xs) == 1 {
+				l.vars[xs[0]] = true
+			} else {
+				l.dynamic = true
+			}
+		case *astSimple:
+			args, ok := staticValues(cmd.args)
+			if !ok {
+				// We can’t know what a dynamic ‘set’ or ‘read’ sets, but
+				// the subject of ‘~’ is usually dynamic while its flags
+				// aren’t
+				xs, ok := staticValues(cmd.args[:1])
+				switch {
+				case ok && xs[0] == "~":
+					l.collectMatch(cmd.args)
+				case !ok || slices.Contains(assigningBuiltins, xs[0]):
+					l.dynamic = true
+				}
+				return
+			}
+			if args[0] == "eval" {
+				l.dynamic = true
+			}
+			for _, v := range assignedVars(args) {
+				l.vars[v] = true
+			}
+		}
+	}
+}
+
+// collectMatch records the variable set by the ‘~’ invocation args, where only
+// the flags need to be static
+func (l *linter) collectMatch(args []astValue) {
+	var xs []string
+	for _, v := range args {
+		ys, ok := staticValues([]astValue{v})
+		if !ok {
+			break
+		}
+		xs = append(xs, ys...)
+	}
+	flags, _, err := opts.GetLong(xs, builtins["~"].longOpts())
+	if err != nil {
+		l.dynamic = true
+		return
+	}
+	for _, f := range flags {
+		if f.Key == 'm' {
+			name, _, _ := splitMapRef(f.Value)
+			l.vars[name] = true
+		}
+	}
+}
+
+// body lints a sequence of top-levels that are executed one after the other.
+// Written contains the files that were written to earlier.
+func (l *linter) body(tls []astTopLevel, written map[string]bool) {
+	written = cloneSet(written)
+	var exited string
+	for _, tl := range tls {
+		pos := topLevelPos(tl)
+		if exited != "" {
+			l.report(pos, "unreachable code after ‘%s’", exited)
+			exited = ""
+		}
+
+		switch tl := tl.(type) {
+		case astFuncDef:
+			l.funcDef(tl)
+		case astCommandList:
+			l.cmdList(tl, written)
+			if cmd, ok := soleSimple(tl); ok {
+				if xs, ok := staticValues(cmd.args[:1]); ok &&
+					(xs[0] == "exit" || xs[0] == "exec" && len(cmd.args) > 1) {
+					exited = xs[0]
+				}
+			}
+		}
+	}
+}
+
+func (l *linter) funcDef(fd astFuncDef) {
+	l.values(fd.args)
+	xs, ok := staticValues(fd.args)
+	if ok {
+		for _, x := range xs[1:] {
+			l.checkAssign(fd.pos, x)
+		}
+	}
+
+	l.inFunc++
+	l.body(fd.body, nil)
+	l.inFunc--
+
+	if ok && l.inFunc == 0 {
+		l.defined[xs[0]] = true
+	}
+}
+
+func (l *linter) cmdList(cl astCommandList, written map[string]bool) {
+	for {
+		for _, cc := range cl.rhs {
+			l.command(cc, written)
+		}
+		if cl.lhs == nil {
+			return
+		}
+		cl = *cl.lhs
+	}
+}
+
+func (l *linter) command(cc astCleanCommand, written map[string]bool) {
+	switch cmd := cc.cmd.(type) {
+	case *astSimple:
+		l.simple(cmd, cc.pos)
+	case *astCompound:
+		l.body(cmd.cmds, written)
+	case *astIf:
+		l.cmdList(cmd.cond, written)
+		l.body(cmd.body, written)
+		l.body(cmd.else_, written)
+	case *astWhile:
+		l.inLoop++
+		l.cmdList(cmd.cond, written)
+		l.body(cmd.body, written)
+		l.inLoop--
+	case *astFor:
+		l.value(cmd.bind)
+		l.values(cmd.vals)
+		if xs, ok := staticValues([]astValue{cmd.bind}); ok && len(xs) == 1 {
+			l.checkAssign(cc.pos, xs[0])
+		}
+		l.inLoop++
+		l.body(cmd.body, written)
+		l.inLoop--
+	case *astDefer:
+		l.body(cmd.body, written)
+	}
+
+	for _, r := range cc.cmd.redirs() {
+		l.value(r.file)
+		l.redirect(r, written)
+	}
+}
+
+func (l *linter) simple(cmd *astSimple, pos position) {
+	l.values(cmd.args)
+	args, ok := staticValues(cmd.args)
+	if !ok {
+		return
+	}
+
+	if l.inFunc == 0 && !l.defined[args[0]] && l.topFuncs[args[0]] {
+		l.report(pos, "function ‘%s’ is called before it is defined", args[0])
+	}
+	for _, v := range assignedVars(args) {
+		l.checkAssign(pos, v)
+	}
+
+	if args[0] == "call" && !l.funcs[args[0]] {
+		flags, rest, err := opts.GetLong(args, builtins["call"].longOpts())
+		if err == nil && len(rest) > 0 && !l.funcs[rest[0]] &&
+			(len(flags) == 0 || hasFlags(flags, 'b', 'c')) {
+			l.report(pos, "redundant ‘call’ as there is no function ‘%s’",
+				rest[0])
+		}
+	}
+}
+
+func (l *linter) checkAssign(pos position, name string) {
+	if slices.Contains(reservedNames, name) {
+		l.report(pos, "the ‘%s’ variable is read-only", name)
+	}
+}
+
+func (l *linter) redirect(r astRedirect, written map[string]bool) {
+	xs, ok := staticValues([]astValue{r.file})
+	if !ok || len(xs) != 1 || xs[0] == "_" {
+		return
+	}
+	file := xs[0]
+
+	switch {
+	case r.kind != redirWrite:
+	case written[file]:
+		l.report(r.pos, "‘>’ to ‘%s’ always fails as the file was written to "+
+			"before; did you mean to use ‘>!’ or ‘>>’?", file)
+	case l.inLoop > 0:
+		l.report(r.pos, "‘>’ to ‘%s’ in a loop fails after the first "+
+			"iteration; did you mean to use ‘>!’ or ‘>>’?", file)
+	}
+	written[file] = true
+}
+
+func (l *linter) values(vs []astValue) {
+	for _, v := range vs {
+		l.value(v)
+	}
+}
+
+func (l *linter) value(v astValue) {
+	switch v := v.(type) {
+	case astVarRef:
+		l.value(v.ident)
+		l.value(v.repl)
+		l.values(v.indices)
+		xs, ok := staticValues([]astValue{v.ident})
+		if !ok || len(xs) != 1 || l.dynamic || v.repl != nil {
+			return
+		}
+		name := xs[0]
+		if !l.vars[name] && !slices.Contains(predefinedVars, name) &&
+			!isEnvName(name) {
+			l.report(v.pos, "the variable ‘%s’ is never set", name)
+		}
+	case astConcat:
+		l.value(v.lhs)
+		l.value(v.rhs)
+	case astList:
+		l.values(v)
+	case astProcSub:
+		l.values(v.seps)
+		l.body(v.body, nil)
+	case *astProcRedir:
+		l.body(v.body, nil)
+	}
+}
+
+// assigningBuiltins are the builtins that assign to variables named in their
+// arguments
+var assigningBuiltins = []string{
+	"async", "pop", "push", "read", "reverse", "set", "shift", "sort",
+	"split", "uniq", "~",
+}
+
+// assignedVars returns the variables assigned to by the builtin invocation
+// args
+func assignedVars(args []string) []string {
+	b, ok := builtins[args[0]]
+	if !ok {
+		return nil
+	}
+	flags, rest, err := opts.GetLong(args, b.longOpts())
+	if err != nil {
+		return nil
+	}
+
+	switch args[0] {
+	case "pop", "push", "reverse", "set", "sort", "split", "uniq":
+		if len(rest) > 0 {
+			name, _, _ := splitMapRef(rest[0])
+			return []string{name}
+		}
+	case "shift":
+		if len(rest) > 0 {
+			name, _, _ := splitMapRef(rest[len(rest)-1])
+			return []string{name}
+		}
+	case "read":
+		return rest
+	case "~":
+		for _, f := range flags {
+			if f.Key == 'm' {
+				name, _, _ := splitMapRef(f.Value)
+				return []string{name}
+			}
+		}
+	case "async":
+		for _, f := range flags {
+			switch {
+			case f.Key != 'i':
+			case f.Value == "":
+				return []string{"_"}
+			default:
+				return []string{f.Value}
+			}
+		}
+	}
+	return nil
+}
+
+// isEnvName reports whether or not name looks like the name of an environment
+// variable, which by convention contain no lowercase letters
+func isEnvName(name string) bool {
+	return strings.IndexFunc(name, unicode.IsLower) == -1
+}
+
+func hasFlags(flags []opts.Flag, rs ...rune) bool {
+	for _, r := range rs {
+		if !slices.ContainsFunc(flags, func(f opts.Flag) bool {
+			return f.Key == r
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// soleSimple returns the simple command that makes up all of cl, if any
+func soleSimple(cl astCommandList) (*astSimple, bool) {
+	if cl.lhs != nil || len(cl.rhs) != 1 {
+		return nil, false
+	}
+	cmd, ok := cl.rhs[0].cmd.(*astSimple)
+	return cmd, ok
+}
+
+func topLevelPos(tl astTopLevel) position {
+	switch tl := tl.(type) {
+	case astFuncDef:
+		return tl.pos
+	case astCommandList:
+		return tl.pos
+	}
+	return position{}
+}
+
+func cloneSet(m map[string]bool) map[string]bool {
+	n := make(map[string]bool, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
+
+// staticValues returns the strings the values vs expand to if they can be
+// known without running any code
+func staticValues(vs []astValue) ([]string, bool) {
+	var xs []string
+	for _, v := range vs {
+		switch v := v.(type) {
+		case astArgument:
+			xs = append(xs, string(v))
+		case astString:
+			xs = append(xs, string(v))
+		case astTilde:
+			xs = append(xs, "~")
+		case astList:
+			ys, ok := staticValues(v)
+			if !ok {
+				return nil, false
+			}
+			xs = append(xs, ys...)
+		case astConcat:
+			lhs, ok1 := staticValues([]astValue{v.lhs})
+			rhs, ok2 := staticValues([]astValue{v.rhs})
+			if !ok1 || !ok2 {
+				return nil, false
+			}
+			for _, x := range lhs {
+				for _, y := range rhs {
+					xs = append(xs, x+y)
+				}
+			}
+		default:
+			return nil, false
+		}
+	}
+	return xs, len(xs) > 0
+}
+
+// inspect calls f for every function definition, command (as an
+// astCleanCommand), and value in tls, including those in nested bodies
+func inspect(tls []astTopLevel, f func(n any)) {
+	for _, tl := range tls {
+		switch tl := tl.(type) {
+		case astFuncDef:
+			f(tl)
+			inspectValues(tl.args, f)
+			inspect(tl.body, f)
+		case astCommandList:
+			inspectCmdList(tl, f)
+		}
+	}
+}
+
+func inspectCmdList(cl astCommandList, f func(n any)) {
+	if cl.lhs != nil {
+		inspectCmdList(*cl.lhs, f)
+	}
+	for _, cc := range cl.rhs {
+		f(cc)
+		switch cmd := cc.cmd.(type) {
+		case *astSimple:
+			inspectValues(cmd.args, f)
+		case *astCompound:
+			inspect(cmd.cmds, f)
+		case *astIf:
+			inspectCmdList(cmd.cond, f)
+			inspect(cmd.body, f)
+			inspect(cmd.else_, f)
+		case *astWhile:
+			inspectCmdList(cmd.cond, f)
+			inspect(cmd.body, f)
+		case *astFor:
+			inspectValues([]astValue{cmd.bind}, f)
+			inspectValues(cmd.vals, f)
+			inspect(cmd.body, f)
+		case *astDefer:
+			inspect(cmd.body, f)
+		}
+		for _, r := range cc.cmd.redirs() {
+			inspectValues([]astValue{r.file}, f)
+		}
+	}
+}
+
+func inspectValues(vs []astValue, f func(n any)) {
+	for _, v := range vs {
+		if v == nil {
+			continue
+		}
+		f(v)
+		switch v := v.(type) {
+		case astVarRef:
+			inspectValues([]astValue{v.ident, v.repl}, f)
+			inspectValues(v.indices, f)
+		case astConcat:
+			inspectValues([]astValue{v.lhs, v.rhs}, f)
+		case astList:
+			inspectValues(v, f)
+		case astProcSub:
+			inspectValues(v.seps, f)
+			inspect(v.body, f)
+		case *astProcRedir:
+			inspect(v.body, f)
+		}
+	}
+}
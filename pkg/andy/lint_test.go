@@ -0,0 +1,65 @@
+package andy
+
+import (
+	"slices"
+	"testing"
+)
+
+func assertLints(t *testing.T, src string, want ...string) {
+	var got []string
+	for _, d := range Lint("", src) {
+		got = append(got, d.String())
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Expected ‘%s’ to report %q but got %q", src, want, got)
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	assertLints(t, "func f x { echo $x $HOME $_ $(y:z) }\n"+
+		"set xs a b; for x in $xs { f $x >>log }; read -g line; echo $line\n"+
+		"async --id=id sleep 1; wait $id; call -c echo $status")
+}
+
+func TestLintVariables(t *testing.T) {
+	assertLints(t, "echo $x; set y 1; echo $y $^z\"\" $#w",
+		"1:6: the variable ‘x’ is never set",
+		"1:27: the variable ‘z’ is never set",
+		"1:33: the variable ‘w’ is never set")
+
+	// Variables set dynamically could be anything
+	assertLints(t, "set $name 1; echo $x")
+	assertLints(t, "eval foo.an; echo $x")
+
+	// The subject of ‘~’ being dynamic doesn’t make its match variable so
+	assertLints(t, "set s a; ~ -r -m m $s '(.)'; echo $m $x",
+		"1:38: the variable ‘x’ is never set")
+}
+
+func TestLintFunctions(t *testing.T) {
+	assertLints(t, "f; func f { g }; func g {}; f",
+		"1:1: function ‘f’ is called before it is defined")
+	assertLints(t, "call foo; call -b foo; func bar {}; call bar",
+		"1:1: redundant ‘call’ as there is no function ‘foo’")
+}
+
+func TestLintRedirects(t *testing.T) {
+	assertLints(t, "echo a >f; echo b >f; echo c >!f; echo d >_; echo e >_",
+		"1:19: ‘>’ to ‘f’ always fails as the file was written to before; "+
+			"did you mean to use ‘>!’ or ‘>>’?")
+	assertLints(t, "while true { echo >f }",
+		"1:19: ‘>’ to ‘f’ in a loop fails after the first iteration; "+
+			"did you mean to use ‘>!’ or ‘>>’?")
+}
+
+func TestLintMisc(t *testing.T) {
+	assertLints(t, "if true { exit 1; echo foo }\nexec ls\necho bar",
+		"1:19: unreachable code after ‘exit’",
+		"3:1: unreachable code after ‘exec’")
+	assertLints(t, "set status 1; func f pid {}; for ppid in a {}",
+		"1:1: the ‘status’ variable is read-only",
+		"1:15: the ‘pid’ variable is read-only",
+		"1:30: the ‘ppid’ variable is read-only")
+	assertLints(t, "echo \"$^x\"",
+		"1:7: The ‘^’ variable prefix is redundant in double-quoted strings")
+}
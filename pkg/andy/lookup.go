@@ -0,0 +1,102 @@
+package andy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A cmdHash caches the locations of executables found in $PATH, so that we
+// don’t need to search $PATH every time we run a command.  It is cleared
+// whenever $PATH is changed, or by the ‘rehash’ builtin.
+type cmdHash struct {
+	m   map[string]string
+	mtx sync.Mutex
+}
+
+func (h *cmdHash) clear() {
+	h.mtx.Lock()
+	clear(h.m)
+	h.mtx.Unlock()
+}
+
+// lookPath returns the path to the executable name, consulting the command
+// hash before searching $PATH
+func (sh *Interpreter) lookPath(ctx context, name string) (string, error) {
+	if strings.ContainsRune(name, '/') {
+		path := ctx.resolve(name)
+		if err := isExecutable(path); err != nil {
+			return "", &exec.Error{Name: name, Err: err}
+		}
+		return path, nil
+	}
+
+	sh.hash.mtx.Lock()
+	defer sh.hash.mtx.Unlock()
+	if path, ok := sh.hash.m[name]; ok {
+		return path, nil
+	}
+
+	for _, dir := range sh.pathDirs() {
+		path := filepath.Join(dir, name)
+		if err := isExecutable(ctx.resolve(path)); err != nil {
+			continue
+		}
+
+		// Relative directories in $PATH depend on the working directory,
+		// so we can’t cache them
+		if filepath.IsAbs(path) {
+			sh.hash.m[name] = path
+		}
+		return ctx.resolve(path), nil
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// lookPathAll returns the paths of every executable called name in $PATH,
+// ignoring the command hash
+func (sh *Interpreter) lookPathAll(ctx context, name string) []string {
+	if strings.ContainsRune(name, '/') {
+		if path, err := sh.lookPath(ctx, name); err == nil {
+			return []string{path}
+		}
+		return nil
+	}
+
+	var xs []string
+	for _, dir := range sh.pathDirs() {
+		path := ctx.resolve(filepath.Join(dir, name))
+		if isExecutable(path) == nil {
+			xs = append(xs, path)
+		}
+	}
+	return xs
+}
+
+func (sh *Interpreter) pathDirs() []string {
+	path, _ := sh.LookupEnv("PATH")
+	xs := filepath.SplitList(path)
+	for i, x := range xs {
+		if x == "" {
+			xs[i] = "."
+		}
+	}
+	return xs
+}
+
+func isExecutable(path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return err
+	case info.IsDir():
+		return errors.New("is a directory")
+	case info.Mode()&0111 == 0:
+		return fs.ErrPermission
+	}
+	return nil
+}
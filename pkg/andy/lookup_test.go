@@ -0,0 +1,76 @@
+package andy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeExecutable(t *testing.T, path, s string) {
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+s+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeExecutable(t, filepath.Join(a, "foo"), "echo a")
+	writeExecutable(t, filepath.Join(b, "foo"), "echo b")
+
+	sh, out, _ := newTestInterpreter()
+	sh.Setenv("PATH", a+string(os.PathListSeparator)+b)
+	err := sh.RunString("func foo { echo f }\n" +
+		"type foo; type -a foo; call -c foo; rehash; type -a echo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	want := "function\n" +
+		"function\n" +
+		"executable " + filepath.Join(a, "foo") + "\n" +
+		"executable " + filepath.Join(b, "foo") + "\n" +
+		"a\n" +
+		"builtin\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestCmdHash(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeExecutable(t, filepath.Join(a, "foo"), "echo a")
+	writeExecutable(t, filepath.Join(b, "foo"), "echo b")
+
+	sh, out, _ := newTestInterpreter()
+	sh.Setenv("PATH", b)
+	sh.RunString("foo")
+	sh.Setenv("PATH", a+string(os.PathListSeparator)+b)
+	sh.RunString("foo")
+
+	// A newly added executable isn’t noticed until we rehash
+	writeExecutable(t, filepath.Join(b, "bar"), "echo bar")
+	writeExecutable(t, filepath.Join(a, "bar"), "echo new bar")
+	sh.RunString("bar")
+	os.Remove(filepath.Join(a, "bar"))
+	sh.RunString("bar")
+	sh.RunString("rehash; bar")
+
+	if s := out.String(); s != "b\na\nnew bar\nbar\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestFunctionLocation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.an")
+	os.WriteFile(path, []byte("echo foo\n\nfunc f {\n\techo f\n}\n"), 0644)
+
+	sh, out, _ := newTestInterpreter()
+	if err := sh.RunFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sh.RunString("type f")
+	if s := out.String(); s != "foo\nfunction "+path+":3\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
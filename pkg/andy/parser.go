@@ -1,16 +1,44 @@
-package main
+package andy
+
+import "errors"
 
 type parser struct {
-	stream <-chan token
-	cache  *token
+	l     *lexer
+	cache *token
+	last  position // Position of the last consumed token
+	funcs int      // Depth of nested function definitions
 }
 
-func newParser(c <-chan token) parser {
-	return parser{stream: c}
+func newParser(l *lexer) parser {
+	return parser{l: l}
 }
 
-func (p *parser) run() astProgram {
-	return p.parseProgram()
+// A parseError is used to unwind the parser when it encounters invalid
+// syntax; see parser.run()
+type parseError struct {
+	err error
+}
+
+func (p *parser) run() (prog astProgram, err error) {
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+		case parseError:
+			err = e.err
+		default:
+			panic(e)
+		}
+	}()
+	return p.parseProgram(), nil
+}
+
+func (p *parser) die(e error) {
+	if e, ok := e.(errExpected); ok {
+		if t, ok := e.got.(token); ok && t.pos.line > 0 {
+			panic(parseError{errSyntax{t.pos, e}})
+		}
+	}
+	panic(parseError{e})
 }
 
 func (p *parser) next() token {
@@ -18,7 +46,10 @@ func (p *parser) next() token {
 	if p.cache != nil {
 		t, p.cache = *p.cache, nil
 	} else {
-		t = <-p.stream
+		t = p.read()
+	}
+	if t.kind != tokEndStmt && t.kind != tokEof {
+		p.last = t.pos
 	}
 	return t
 }
@@ -28,14 +59,23 @@ func (p *parser) peek() token {
 		return *p.cache
 	}
 
-	t, ok := <-p.stream
-	if !ok {
-		t = token{kind: tokEof}
-	}
+	t := p.read()
 	p.cache = &t
 	return t
 }
 
+// read returns the next token from the lexer, failing on lexing errors
+func (p *parser) read() token {
+	t, ok := p.l.token()
+	switch {
+	case !ok:
+		t = token{kind: tokEof, pos: p.last}
+	case t.kind == tokError:
+		p.die(errSyntax{t.pos, errors.New(t.val)})
+	}
+	return t
+}
+
 func (p *parser) parseProgram() astProgram {
 	var prog astProgram
 
@@ -54,7 +94,7 @@ func (p *parser) parseProgram() astProgram {
 }
 
 func (p *parser) parseFuncDef() astFuncDef {
-	p.next() // skip ‘func’
+	pos := p.next().pos // skip ‘func’
 
 	args := make([]astValue, 0, 4)
 	args = append(args, p.parseValue())
@@ -62,14 +102,17 @@ func (p *parser) parseFuncDef() astFuncDef {
 		args = append(args, p.parseValue())
 	}
 	if t := p.next(); t.kind != tokBraceOpen {
-		die(errExpected{"opening brace", t})
+		p.die(errExpected{"opening brace", t})
 	}
-	body := p.parseBody()
+	p.funcs++
+	body, end := p.parseBody()
+	p.funcs--
 
-	return astFuncDef{args, body}
+	return astFuncDef{args, body, pos, end}
 }
 
 func (p *parser) parseCommandList() astCommandList {
+	pos := p.peek().pos
 	xlist := p.parseXCommandList()
 	cmdList := astCommandList{lhs: nil, rhs: xlist.lhs}
 	op := xlist.op
@@ -85,6 +128,7 @@ func (p *parser) parseCommandList() astCommandList {
 		op = xlist.op
 	}
 
+	cmdList.pos, cmdList.end = pos, p.last
 	return cmdList
 }
 
@@ -129,6 +173,7 @@ func (p *parser) parsePipeline() astPipeline {
 
 func (p *parser) parseCommand() astCleanCommand {
 	var cmd astCommand
+	pos := p.peek().pos
 
 	switch t := p.peek(); {
 	case t.kind == tokArg && t.val == "if":
@@ -140,6 +185,12 @@ func (p *parser) parseCommand() astCleanCommand {
 	case t.kind == tokArg && t.val == "for":
 		p.next()
 		cmd = p.parseFor()
+	case t.kind == tokArg && t.val == "defer":
+		p.next()
+		if p.funcs == 0 {
+			p.die(errSyntax{t.pos, errors.New("‘defer’ is only allowed in functions")})
+		}
+		cmd = p.parseDefer()
 	case t.kind == tokBraceOpen:
 		p.next()
 		cmd = p.parseCompound()
@@ -153,20 +204,21 @@ func (p *parser) parseCommand() astCleanCommand {
 		case isRedirTok(t.kind):
 			p.next()
 			r := newRedir(t.kind)
+			r.pos = t.pos
 
 			switch {
 			case isValueTok(p.peek().kind):
 				r.file = p.parseValue()
 			default:
-				die(errExpected{"file after redirect", t})
+				p.die(errExpected{"file after redirect", t})
 			}
 
 			redirs = append(redirs, r)
 		case isValueTok(t.kind):
-			die(errExpected{"semicolon or newline", t})
+			p.die(errExpected{"semicolon or newline", t})
 		default:
 			cmd.setRedirs(redirs)
-			return astCleanCommand{cmd: cmd}
+			return astCleanCommand{cmd: cmd, pos: pos}
 		}
 	}
 }
@@ -175,12 +227,21 @@ func (p *parser) parseWhile() *astWhile {
 	var w astWhile
 	w.cond = p.parseCommandList()
 	if t := p.next(); t.kind != tokBraceOpen {
-		die(errExpected{"opening brace", t})
+		p.die(errExpected{"opening brace", t})
 	}
-	w.body = p.parseBody()
+	w.body, w.end = p.parseBody()
 	return &w
 }
 
+func (p *parser) parseDefer() *astDefer {
+	var d astDefer
+	if t := p.next(); t.kind != tokBraceOpen {
+		p.die(errExpected{"opening brace", t})
+	}
+	d.body, d.end = p.parseBody()
+	return &d
+}
+
 func (p *parser) parseFor() *astFor {
 	var (
 		f      astFor
@@ -206,9 +267,9 @@ func (p *parser) parseFor() *astFor {
 	}
 
 	if t := p.next(); t.kind != tokBraceOpen {
-		die(errExpected{"opening brace", t})
+		p.die(errExpected{"opening brace", t})
 	}
-	f.body = p.parseBody()
+	f.body, f.end = p.parseBody()
 	f.bind = bind
 	return &f
 }
@@ -217,9 +278,9 @@ func (p *parser) parseIf() *astIf {
 	cond := astIf{cond: p.parseCommandList()}
 
 	if t := p.next(); t.kind != tokBraceOpen {
-		die(errExpected{"opening brace", t})
+		p.die(errExpected{"opening brace", t})
 	}
-	cond.body = p.parseBody()
+	cond.body, cond.end = p.parseBody()
 
 	if t := p.peek(); t.kind != tokArg || t.val != "else" {
 		goto out
@@ -232,16 +293,18 @@ func (p *parser) parseIf() *astIf {
 		})
 	} else {
 		if t := p.next(); t.kind != tokBraceOpen {
-			die(errExpected{"opening brace", t})
+			p.die(errExpected{"opening brace", t})
 		}
-		cond.else_ = p.parseBody()
+		cond.else_, cond.elseEnd = p.parseBody()
 	}
 
 out:
 	return &cond
 }
 
-func (p *parser) parseBody() []astTopLevel {
+// parseBody parses the body of a block up to and including the closing brace,
+// returning the position of the brace
+func (p *parser) parseBody() ([]astTopLevel, position) {
 	xs := []astTopLevel{}
 
 	for {
@@ -250,9 +313,9 @@ func (p *parser) parseBody() []astTopLevel {
 			p.next()
 		case t.kind == tokBraceClose:
 			p.next()
-			return xs
+			return xs, t.pos
 		case t.kind == tokEof:
-			die(errExpected{"closing brace", t})
+			p.die(errExpected{"closing brace", t})
 		case t.kind == tokArg && t.val == "func":
 			xs = append(xs, p.parseFuncDef())
 		default:
@@ -265,14 +328,14 @@ func (p *parser) parseCompound() *astCompound {
 	cmds := make([]astTopLevel, 0, 4) // Add a little capacity
 
 	for {
-		switch p.peek().kind {
+		switch t := p.peek(); t.kind {
 		case tokBraceClose:
 			p.next()
-			return &astCompound{cmds: cmds}
+			return &astCompound{cmds: cmds, end: t.pos}
 		case tokEndStmt:
 			p.next()
 		case tokEof:
-			die(errExpected{"closing brace", p.peek()})
+			p.die(errExpected{"closing brace", p.peek()})
 		default:
 			cmds = append(cmds, p.parseCommandList())
 		}
@@ -295,9 +358,19 @@ func (p *parser) parseValue() astValue {
 
 	switch t := p.next(); t.kind {
 	case tokArg:
-		v = astArgument(t.val)
+		if t.val == "~" && p.peek().kind != tokConcat {
+			v = astTilde{}
+		} else {
+			v = astArgument(t.val)
+		}
 	case tokString:
 		v = astString(t.val)
+	case tokArith:
+		expr, err := parseArith(t.val)
+		if err != nil {
+			p.die(errSyntax{t.pos, err})
+		}
+		v = astArith{expr, t.val}
 	case tokVarRef, tokVarFlat, tokVarLen:
 		vr := newVarRef(t)
 		if vr.ident == nil && p.peek().kind == tokParenOpen {
@@ -308,7 +381,7 @@ func (p *parser) parseValue() astValue {
 				vr.repl = p.parseValue()
 			}
 			if p.peek().kind != tokParenClose {
-				die(errExpected{"closing parenthesis", t})
+				p.die(errExpected{"closing parenthesis", t})
 			}
 			p.next()
 		}
@@ -318,24 +391,27 @@ func (p *parser) parseValue() astValue {
 		v = vr
 	case tokParenOpen:
 		v = p.parseList()
-	case tokProcRead:
-		v = &astProcRedir{kind: procRead, body: p.parseBody()}
-	case tokProcWrite:
-		v = &astProcRedir{kind: procWrite, body: p.parseBody()}
-	case tokProcRdWr:
-		v = &astProcRedir{
-			kind: procRead | procWrite,
-			body: p.parseBody(),
+	case tokProcRead, tokProcWrite, tokProcRdWr:
+		pr := &astProcRedir{kind: procRead | procWrite}
+		switch t.kind {
+		case tokProcRead:
+			pr.kind = procRead
+		case tokProcWrite:
+			pr.kind = procWrite
 		}
+		pr.body, pr.end = p.parseBody()
+		v = pr
 	case tokProcSub:
 		var seps []astValue
 		if p.peek().kind == tokParenOpen {
 			p.next()
 			seps = p.parseList()
 		}
-		v = astProcSub{seps: seps, body: p.parseBody()}
+		ps := astProcSub{seps: seps}
+		ps.body, ps.end = p.parseBody()
+		v = ps
 	default:
-		die(errExpected{"value", t})
+		p.die(errExpected{"value", t})
 	}
 
 	if p.peek().kind == tokConcat {
@@ -353,7 +429,7 @@ func (p *parser) parseIndices() []astValue {
 		xs = append(xs, p.parseValue())
 	}
 	if p.peek().kind != tokBracketClose {
-		die(errExpected{"closing bracket", p.next()})
+		p.die(errExpected{"closing bracket", p.next()})
 	}
 	p.next()
 	return xs
@@ -370,7 +446,7 @@ func (p *parser) parseList() astList {
 		case t.kind == tokEndStmt:
 			p.next()
 		case !isValueTok(t.kind):
-			die(errExpected{"value", t})
+			p.die(errExpected{"value", t})
 		default:
 			xs = append(xs, p.parseValue())
 		}
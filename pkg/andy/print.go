@@ -0,0 +1,637 @@
+package andy
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A printer turns an AST back into canonical Andy source code.  When
+// formatting source code the printer additionally follows the layout of the
+// source where it matters, such as blank lines between statements and
+// multi-line pipelines, and interleaves the comments of the source.
+type printer struct {
+	sb     strings.Builder
+	indent int
+
+	layout   bool
+	comments []comment // Comments yet to be printed
+	line     int       // Source line of the last thing printed
+	noBlank  bool      // Set after opening a brace to skip blank lines
+}
+
+func (p Program) String() string {
+	var pr printer
+	pr.topLevels(p.tls, 0)
+	if pr.sb.Len() > 0 {
+		pr.sb.WriteByte('\n')
+	}
+	return pr.sb.String()
+}
+
+// Format returns the Andy source code in src formatted in canonical style.
+// Comments and single blank lines between statements are preserved.  The name
+// of the file is only used in error messages.
+func Format(name, src string) (string, error) {
+	prog, comments, err := parse(name, src)
+	if err != nil {
+		return "", err
+	}
+	// Lists are printed on a single line, so there’s nowhere to put these
+	for _, c := range comments {
+		if c.inList {
+			return "", errSyntax{c.pos, errors.New("comments inside lists can’t be formatted")}
+		}
+	}
+
+	pr := printer{layout: true, comments: comments}
+	pr.topLevels(prog, math.MaxInt)
+	if pr.sb.Len() > 0 {
+		pr.sb.WriteByte('\n')
+	}
+	return pr.sb.String(), nil
+}
+
+func (p *printer) newline() {
+	p.sb.WriteByte('\n')
+	for i := 0; i < p.indent; i++ {
+		p.sb.WriteByte('\t')
+	}
+}
+
+// startLine starts a new line of output for something from the given source
+// line.  Any number of blank lines in the source become a single one.
+func (p *printer) startLine(line int) {
+	if p.sb.Len() > 0 {
+		if p.layout && !p.noBlank && p.line > 0 && line > p.line+1 {
+			p.sb.WriteByte('\n')
+		}
+		p.newline()
+	}
+	p.noBlank = false
+	p.setLine(line)
+}
+
+func (p *printer) setLine(line int) {
+	if p.layout {
+		p.line = max(p.line, line)
+	}
+}
+
+// commentsBefore prints the comments that come before the given source line.
+// Comments on the same line as the last thing printed stay on that line.
+func (p *printer) commentsBefore(line int) {
+	for p.hasComments(line) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		if c.pos.line == p.line {
+			p.sb.WriteByte(' ')
+		} else {
+			p.startLine(c.pos.line)
+		}
+		p.sb.WriteString(c.text)
+	}
+}
+
+func (p *printer) hasComments(line int) bool {
+	return len(p.comments) > 0 && p.comments[0].pos.line < line
+}
+
+// topLevels prints each top-level on its own line, followed by any comments
+// before the source line end
+func (p *printer) topLevels(tls []astTopLevel, end int) {
+	for _, tl := range tls {
+		var pos, last position
+		switch tl := tl.(type) {
+		case astFuncDef:
+			pos, last = tl.pos, tl.end
+		case astCommandList:
+			pos, last = tl.pos, tl.end
+		}
+
+		p.commentsBefore(pos.line)
+		p.startLine(pos.line)
+		p.topLevel(tl)
+		p.setLine(last.line)
+	}
+	p.commentsBefore(end)
+}
+
+func (p *printer) topLevel(tl astTopLevel) {
+	switch tl := tl.(type) {
+	case astFuncDef:
+		p.sb.WriteString("func ")
+		p.values(tl.args)
+		p.sb.WriteByte(' ')
+		p.body(tl.body, tl.end)
+	case astCommandList:
+		p.cmdList(tl)
+	}
+}
+
+func (p *printer) function(name string, f function) {
+	p.sb.WriteString("func ")
+	p.sb.WriteString(quoteWord(name))
+	for _, a := range f.args {
+		p.sb.WriteByte(' ')
+		p.sb.WriteString(quoteWord(a))
+	}
+	p.sb.WriteByte(' ')
+	p.body(f.body, position{})
+	p.sb.WriteByte('\n')
+}
+
+func (p *printer) variable(name string, xs []string) {
+	p.sb.WriteString("set ")
+	p.sb.WriteString(quoteWord(name))
+	if len(xs) == 0 {
+		p.sb.WriteString(" ()")
+	}
+	for _, x := range xs {
+		p.sb.WriteByte(' ')
+		p.sb.WriteString(quoteWord(x))
+	}
+	p.sb.WriteByte('\n')
+}
+
+// mapVar prints the commands setting each element of the map variable name
+func (p *printer) mapVar(name string, mv *mapVar) {
+	for _, k := range mv.keys() {
+		p.variable(name+"["+k+"]", mv.m[k])
+	}
+}
+
+// body prints a braced block of code whose closing brace is at end
+func (p *printer) body(tls []astTopLevel, end position) {
+	if len(tls) == 0 && !p.hasComments(end.line) {
+		p.sb.WriteString("{}")
+		p.setLine(end.line)
+		return
+	}
+
+	p.sb.WriteByte('{')
+	p.indent++
+	p.noBlank = true
+	p.topLevels(tls, end.line)
+	p.indent--
+	p.newline()
+	p.sb.WriteByte('}')
+	p.setLine(end.line)
+}
+
+// inlineBody prints a braced block of code on a single line if possible, for
+// use in process substitutions and compound commands.  If spaced is true the
+// code is padded with spaces from the braces.
+func (p *printer) inlineBody(tls []astTopLevel, end position, spaced bool) {
+	inline := !p.layout || end.line <= p.line && !p.hasComments(end.line)
+	for _, tl := range tls {
+		inline = inline && isInline(tl)
+	}
+	if !inline {
+		p.body(tls, end)
+		return
+	}
+
+	p.sb.WriteByte('{')
+	if spaced && len(tls) > 0 {
+		p.sb.WriteByte(' ')
+	}
+	for i, tl := range tls {
+		if i > 0 {
+			p.sb.WriteString("; ")
+		}
+		p.topLevel(tl)
+	}
+	if spaced && len(tls) > 0 {
+		p.sb.WriteByte(' ')
+	}
+	p.sb.WriteByte('}')
+}
+
+// isInline reports whether or not tl can be printed on a single line
+func isInline(tl astTopLevel) bool {
+	cl, ok := tl.(astCommandList)
+	if !ok {
+		return false
+	}
+	for {
+		for _, cc := range cl.rhs {
+			switch cmd := cc.cmd.(type) {
+			case *astCompound:
+				for _, tl := range cmd.cmds {
+					if !isInline(tl) {
+						return false
+					}
+				}
+			case *astSimple:
+			default:
+				return false
+			}
+		}
+		if cl.lhs == nil {
+			return true
+		}
+		cl = *cl.lhs
+	}
+}
+
+func (p *printer) cmdList(cl astCommandList) {
+	if cl.lhs != nil {
+		p.cmdList(*cl.lhs)
+		op := "&&"
+		if cl.op == binOr {
+			op = "||"
+		}
+		if line := cl.rhs[0].pos.line; p.layout && line > p.line {
+			p.commentsBefore(line)
+			p.startLine(line)
+			p.sb.WriteString(op + " ")
+		} else {
+			p.sb.WriteString(" " + op + " ")
+		}
+	}
+	p.pipeline(cl.rhs)
+}
+
+// pipeline prints a pipeline.  When formatting, commands that start on a new
+// line in the source code are put on a new line starting with the pipe.
+func (p *printer) pipeline(pl astPipeline) {
+	for i, cc := range pl {
+		if line := cc.pos.line; i > 0 && p.layout && line > p.line {
+			p.commentsBefore(line)
+			p.startLine(line)
+			p.sb.WriteString("| ")
+		} else if i > 0 {
+			p.sb.WriteString(" | ")
+		}
+		p.setLine(cc.pos.line)
+		p.command(cc.cmd)
+	}
+}
+
+func (p *printer) command(cmd astCommand) {
+	switch cmd := cmd.(type) {
+	case *astSimple:
+		p.values(cmd.args)
+	case *astCompound:
+		p.inlineBody(cmd.cmds, cmd.end, true)
+	case *astIf:
+		p.ifCmd(cmd)
+	case *astWhile:
+		p.sb.WriteString("while ")
+		p.cmdList(cmd.cond)
+		p.sb.WriteByte(' ')
+		p.body(cmd.body, cmd.end)
+	case *astFor:
+		p.sb.WriteString("for ")
+		if a, ok := cmd.bind.(astArgument); !ok || a != "_" {
+			p.value(cmd.bind)
+			p.sb.WriteString(" in")
+			if len(cmd.vals) > 0 {
+				p.sb.WriteByte(' ')
+			}
+		}
+		p.values(cmd.vals)
+		p.sb.WriteByte(' ')
+		p.body(cmd.body, cmd.end)
+	case *astDefer:
+		p.sb.WriteString("defer ")
+		p.body(cmd.body, cmd.end)
+	}
+
+	for _, r := range cmd.redirs() {
+		p.sb.WriteByte(' ')
+		p.redirect(r)
+	}
+}
+
+func (p *printer) ifCmd(cmd *astIf) {
+	p.sb.WriteString("if ")
+	p.cmdList(cmd.cond)
+	p.sb.WriteByte(' ')
+	p.body(cmd.body, cmd.end)
+	if len(cmd.else_) == 0 && !p.hasComments(cmd.elseEnd.line) {
+		return
+	}
+
+	p.sb.WriteString(" else ")
+	if elif, ok := elseIf(cmd.else_); ok {
+		p.ifCmd(elif)
+	} else {
+		p.body(cmd.else_, cmd.elseEnd)
+	}
+}
+
+// elseIf returns the if-command of an ‘else if’ clause.  These are parsed as
+// an else-block containing nothing but an if-command without redirections.
+func elseIf(tls []astTopLevel) (*astIf, bool) {
+	if len(tls) != 1 {
+		return nil, false
+	}
+	cl, ok := tls[0].(astCommandList)
+	if !ok || cl.lhs != nil || len(cl.rhs) != 1 {
+		return nil, false
+	}
+	cmd, ok := cl.rhs[0].cmd.(*astIf)
+	return cmd, ok && len(cmd.rs) == 0
+}
+
+func (p *printer) redirect(r astRedirect) {
+	switch r.kind {
+	case redirAppend:
+		p.sb.WriteString(">>")
+	case redirClob:
+		p.sb.WriteString(">!")
+	case redirRead, redirSockRead:
+		p.sb.WriteByte('<')
+	case redirWrite, redirSockWrite:
+		p.sb.WriteByte('>')
+	}
+	p.value(r.file)
+}
+
+func (p *printer) values(vs []astValue) {
+	for i, v := range vs {
+		if i > 0 {
+			p.sb.WriteByte(' ')
+		}
+		p.value(v)
+	}
+}
+
+func (p *printer) value(v astValue) {
+	switch v := v.(type) {
+	case astArgument:
+		p.sb.WriteString(escapeArg(string(v)))
+	case astString:
+		p.sb.WriteString(quoteString(string(v)))
+	case astTilde:
+		p.sb.WriteByte('~')
+	case astVarRef:
+		p.varRef(v, false)
+	case astArith:
+		p.sb.WriteString("$[" + v.src + "]")
+	case astConcat:
+		p.concat(v)
+	case astList:
+		p.sb.WriteByte('(')
+		p.values(v)
+		p.sb.WriteByte(')')
+	case astProcSub:
+		p.sb.WriteByte('`')
+		if len(v.seps) > 0 {
+			p.value(v.seps)
+		}
+		p.inlineBody(v.body, v.end, false)
+	case *astProcRedir:
+		switch {
+		case v.is(procRead) && v.is(procWrite):
+			p.sb.WriteString("<>")
+		case v.is(procRead):
+			p.sb.WriteByte('<')
+		case v.is(procWrite):
+			p.sb.WriteByte('>')
+		}
+		p.inlineBody(v.body, v.end, false)
+	}
+}
+
+// varRef prints a variable reference.  If parens is true, the name of the
+// variable is always wrapped in parenthesis so that it doesn’t run into
+// whatever comes after it.
+func (p *printer) varRef(vr astVarRef, parens bool) {
+	switch vr.kind {
+	case vrExpand:
+		p.sb.WriteByte('$')
+	case vrFlatten:
+		p.sb.WriteString("$^")
+	case vrLength:
+		p.sb.WriteString("$#")
+	}
+
+	ident, ok := vr.ident.(astArgument)
+	if ok && vr.repl == nil && !parens && isRefNameNonEmpty(string(ident)) {
+		p.sb.WriteString(string(ident))
+	} else {
+		p.sb.WriteByte('(')
+		p.value(vr.ident)
+		if vr.repl != nil {
+			p.sb.WriteByte(':')
+			p.value(vr.repl)
+		}
+		p.sb.WriteByte(')')
+	}
+
+	if vr.indices != nil {
+		p.sb.WriteByte('[')
+		p.values(vr.indices)
+		p.sb.WriteByte(']')
+	}
+}
+
+func (p *printer) concat(c astConcat) {
+	xs := flattenConcat(c)
+	for i := len(xs) - 1; i > 0; i-- {
+		a, ok1 := xs[i-1].(astString)
+		b, ok2 := xs[i].(astString)
+		if ok1 && ok2 {
+			xs[i-1] = a + b
+			xs = slices.Delete(xs, i, i+1)
+		}
+	}
+	if len(xs) == 1 {
+		p.value(xs[0])
+		return
+	}
+
+	if s, ok := doubleQuote(xs); ok {
+		p.sb.WriteString(s)
+		return
+	}
+
+	// Concatenating the empty string with anything else does nothing
+	xs = slices.DeleteFunc(xs, func(x astValue) bool {
+		s, ok := x.(astString)
+		return ok && s == ""
+	})
+	if len(xs) == 1 {
+		p.value(xs[0])
+		return
+	}
+
+	for i, x := range xs {
+		vr, ok := x.(astVarRef)
+		if !ok {
+			p.value(x)
+			continue
+		}
+
+		// A variable reference followed by something that could be part
+		// of its name or an index needs to be parenthesized
+		var parens bool
+		if i < len(xs)-1 && vr.indices == nil {
+			if a, ok := xs[i+1].(astArgument); ok {
+				r, _ := utf8.DecodeRuneInString(escapeArg(string(a)))
+				parens = isRefRune(r) || r == '['
+			}
+		}
+		p.varRef(vr, parens)
+	}
+}
+
+func flattenConcat(v astValue) []astValue {
+	if c, ok := v.(astConcat); ok {
+		return append(flattenConcat(c.lhs), flattenConcat(c.rhs)...)
+	}
+	return []astValue{v}
+}
+
+// doubleQuote returns the double-quoted string equivalent to the concatination
+// of xs if it consists solely of strings, flattened variables, variable
+// lengths, and arithmetic expansions
+func doubleQuote(xs []astValue) (string, bool) {
+	var sawStr, sawVar bool
+	for _, x := range xs {
+		switch x := x.(type) {
+		case astString:
+			sawStr = true
+		case astVarRef:
+			ident, ok := x.ident.(astArgument)
+			if !ok || x.kind == vrExpand || x.repl != nil || x.indices != nil ||
+				!isRefNameNonEmpty(string(ident)) {
+				return "", false
+			}
+			sawVar = true
+		case astArith:
+			sawVar = true
+		default:
+			return "", false
+		}
+	}
+	if !sawStr || !sawVar {
+		return "", false
+	}
+
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+	for i, x := range xs {
+		switch x := x.(type) {
+		case astString:
+			writeDoubleQuoted(&sb, string(x))
+		case astVarRef:
+			ident := string(x.ident.(astArgument))
+			sb.WriteByte('$')
+			if x.kind == vrLength {
+				sb.WriteByte('#')
+			}
+			next := ""
+			if i < len(xs)-1 {
+				if s, ok := xs[i+1].(astString); ok {
+					next = string(s)
+				}
+			}
+			if r, _ := utf8.DecodeRuneInString(next); isRefRune(r) || r == '[' {
+				sb.WriteString("(" + ident + ")")
+			} else {
+				sb.WriteString(ident)
+			}
+		case astArith:
+			sb.WriteString("$[" + x.src + "]")
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String(), true
+}
+
+// escapedRunes maps runes to the escape sequences used to represent them in
+// arguments and double-quoted strings
+var escapedRunes = map[rune]string{
+	'\\':   `\\`,
+	'\000': `\0`,
+	'\a':   `\a`,
+	'\b':   `\b`,
+	'\f':   `\f`,
+	'\n':   `\n`,
+	'\r':   `\r`,
+	'\t':   `\t`,
+	'\v':   `\v`,
+}
+
+func writeDoubleQuoted(sb *strings.Builder, s string) {
+	for i, r := range s {
+		switch {
+		case escapedRunes[r] != "":
+			sb.WriteString(escapedRunes[r])
+		case r == '"', r == '$', r == '`' && strings.HasPrefix(s[i+1:], "{"):
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+// escapeArg escapes the argument s such that it lexes back into the same
+// argument
+func escapeArg(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	sb := strings.Builder{}
+	for i, r := range s {
+		switch {
+		case escapedRunes[r] != "":
+			sb.WriteString(escapedRunes[r])
+		case r == '&':
+			// A lone ‘&’ is a regular character
+			if strings.HasPrefix(s[i+1:], "&") {
+				sb.WriteByte('\\')
+			}
+			sb.WriteRune(r)
+		case unicode.IsSpace(r), isMetachar(r),
+			i == 0 && (r == '{' || r == '#'):
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// quoteString quotes the string s, preferring single quotes
+func quoteString(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool {
+		return r == '\'' || !unicode.IsPrint(r) && r != ' '
+	}) == -1 {
+		return "'" + s + "'"
+	}
+
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+	writeDoubleQuoted(&sb, s)
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// quoteWord returns s as-is if it can be used as a bare argument, and quoted
+// otherwise
+func quoteWord(s string) string {
+	if s == "" || s[0] == '~' || strings.HasPrefix(s, "r#") ||
+		strings.IndexFunc(s, func(r rune) bool {
+			return !unicode.IsPrint(r) || unicode.IsSpace(r) || isMetachar(r) ||
+				isClosing(r) || isEol(r) || r == '#' || r == '\\' || r == ':'
+		}) != -1 {
+		return quoteString(s)
+	}
+	return s
+}
+
+func isRefNameNonEmpty(s string) bool {
+	ok, _ := isRefName(s)
+	return ok && s != ""
+}
@@ -0,0 +1,117 @@
+package andy
+
+import "testing"
+
+func assertPrints(t *testing.T, src, want string) {
+	prog, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Failed to parse ‘%s’: %s", src, err)
+	}
+	if s := prog.String(); s != want {
+		t.Fatalf("Expected ‘%s’ to print as ‘%s’ but got ‘%s’", src, want, s)
+	}
+
+	// Printing should be idempotent
+	prog, err = Parse(want)
+	if err != nil {
+		t.Fatalf("Failed to parse ‘%s’: %s", want, err)
+	}
+	if s := prog.String(); s != want {
+		t.Fatalf("Expected ‘%s’ to print as itself but got ‘%s’", want, s)
+	}
+}
+
+func TestPrintSimple(t *testing.T) {
+	assertPrints(t, "echo   foo 'bar'    \"baz\"", "echo foo 'bar' 'baz'\n")
+	assertPrints(t, "echo a\\ b \\$x \\{ \"it's\" r#'it's'#", "echo a\\ b \\$x \\{ \"it's\" \"it's\"\n")
+	assertPrints(t, "echo 'foo''bar' \"a\\tb\"", "echo 'foobar' \"a\\tb\"\n")
+	assertPrints(t, "echo ~ ~/foo '~'", "echo ~ ~/foo '~'\n")
+	assertPrints(t, "a; b\n\n\nc", "a\nb\nc\n")
+}
+
+func TestPrintValues(t *testing.T) {
+	assertPrints(t, "echo (a b).c foo(x y) (a b)(c d)", "echo (a b).c foo(x y) (a b)(c d)\n")
+	assertPrints(t, "echo $x $^x $#x $(x)y $x'y' $x.c", "echo $x $^x $#x $(x)y $x'y' $x.c\n")
+	assertPrints(t, "echo $xs[1 -2 0..3] $(xs)[0] $(x:foo) $(x:'a b')", "echo $xs[1 -2 0..3] $xs[0] $(x:foo) $(x:'a b')\n")
+	assertPrints(t, "echo \"Hello $name!\" \"$(x)y\" \"a\\$b\"", "echo \"Hello $name!\" \"$(x)y\" 'a$b'\n")
+	assertPrints(t, "echo $[ i+1 ] x$[(1)]y \"n=$[n * 2]\"", "echo $[ i+1 ] x$[(1)]y \"n=$[n * 2]\"\n")
+	assertPrints(t, "echo \"Loop $#xs\" \"$#xs\" \"$#(x)y\" \"\"$xs", "echo \"Loop $#xs\" \"$#xs\" \"$#(x)y\" $xs\n")
+}
+
+func TestPrintProcSub(t *testing.T) {
+	assertPrints(t, "echo `{ls}; echo `ls; echo `(: ' '){echo a:b}",
+		"echo `{ls}\necho `{ls}\necho `(: ' '){echo a:b}\n")
+	assertPrints(t, "diff <{a} >{b} <>{c; d}", "diff <{a} >{b} <>{c; d}\n")
+}
+
+func TestPrintCommands(t *testing.T) {
+	assertPrints(t, "a && b || c | d >>f <g >!h >_", "a && b || c | d >>f <g >!h >_\n")
+	assertPrints(t, "{a; b } >f", "{ a; b } >f\n")
+	assertPrints(t, "if a { b } else if c { d } else { e }",
+		"if a {\n\tb\n} else if c {\n\td\n} else {\n\te\n}\n")
+	assertPrints(t, "while a && b { if c { d } }",
+		"while a && b {\n\tif c {\n\t\td\n\t}\n}\n")
+	assertPrints(t, "for a b { echo $_ }; for x in a b { echo $x }",
+		"for a b {\n\techo $_\n}\nfor x in a b {\n\techo $x\n}\n")
+	assertPrints(t, "func f x y { echo $x $y }; func g {}",
+		"func f x y {\n\techo $x $y\n}\nfunc g {}\n")
+	assertPrints(t, "func f { defer { a } >f; b }",
+		"func f {\n\tdefer {\n\t\ta\n\t} >f\n\tb\n}\n")
+}
+
+func TestWhatis(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	err := sh.RunString("func f x { echo $x | tr a-z A-Z }; set xs a 'b c'\n" +
+		"whatis f xs; type -s f")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	f := "func f x {\n\techo $x | tr a-z A-Z\n}\n"
+	if s := out.String(); s != f+"set xs a 'b c'\n"+f {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func assertFormats(t *testing.T, src, want string) {
+	s, err := Format("", src)
+	if err != nil {
+		t.Fatalf("Failed to format ‘%s’: %s", src, err)
+	}
+	if s != want {
+		t.Fatalf("Expected ‘%s’ to format as ‘%s’ but got ‘%s’", src, want, s)
+	}
+	if s, _ = Format("", want); s != want {
+		t.Fatalf("Expected ‘%s’ to format as itself but got ‘%s’", want, s)
+	}
+
+	// Formatting must not change the meaning of the code
+	p1, _ := Parse(src)
+	p2, _ := Parse(want)
+	if p1.String() != p2.String() {
+		t.Fatalf("Formatting ‘%s’ changed its meaning to ‘%s’", src, p2)
+	}
+}
+
+func TestFormatComments(t *testing.T) {
+	assertFormats(t, "#!/bin/andy\n# foo   \necho foo   # bar\n# baz",
+		"#!/bin/andy\n# foo\necho foo # bar\n# baz\n")
+	assertFormats(t, "func f { # foo\n  # bar\n  a\n  # baz\n}",
+		"func f { # foo\n\t# bar\n\ta\n\t# baz\n}\n")
+	assertFormats(t, "func f {\n# todo\n}\nif a {\n} else {\n  # nothing\n}",
+		"func f {\n\t# todo\n}\nif a {} else {\n\t# nothing\n}\n")
+
+	if _, err := Format("", "set xs (a # b\n c)"); err == nil ||
+		err.Error() != "1:11: comments inside lists can’t be formatted" {
+		t.Fatalf("Expected an error formatting a comment in a list but got %v", err)
+	}
+}
+
+func TestFormatLayout(t *testing.T) {
+	assertFormats(t, "\n\na\n\n\n\nb\nc\n\n", "a\n\nb\nc\n")
+	assertFormats(t, "if a {\n\n  b\n\n}", "if a {\n\tb\n}\n")
+	assertFormats(t, "grep foo # find\n| sort\n\n# number\n| nl | cat",
+		"grep foo # find\n| sort\n\n# number\n| nl | cat\n")
+	assertFormats(t, "a &&\nb || c\n|| d", "a\n&& b || c\n|| d\n")
+	assertFormats(t, "echo `{\nls\n} `{ls}\n{ a\nb } >f\n{ a; b } >f",
+		"echo `{\n\tls\n} `{ls}\n{\n\ta\n\tb\n} >f\n{ a; b } >f\n")
+}
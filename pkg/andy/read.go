@@ -0,0 +1,153 @@
+package andy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// An inputReader reads the standard input of the ‘read’ builtin.  The input
+// may be shared with other commands, so it never consumes more than it is
+// asked for: input that can be given back once we’re done is read in large
+// chunks, while pipes and terminals are read a byte at a time unless all of
+// their input is going to be consumed anyway.
+type inputReader struct {
+	r    io.Reader
+	br   io.ByteReader
+	seek io.Seeker
+	buf  []byte
+	i, n int
+}
+
+func newInputReader(r io.Reader, greedy bool) *inputReader {
+	ir := &inputReader{r: r}
+	switch r := r.(type) {
+	case io.ByteReader:
+		// Buffered readers don’t make syscalls, and consume exactly one
+		// byte at a time
+		ir.br = r
+		return ir
+	case *os.File:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			ir.seek = r
+			greedy = true
+		}
+	}
+
+	if greedy {
+		ir.buf = make([]byte, 32*1024)
+	} else {
+		ir.buf = make([]byte, 1)
+	}
+	return ir
+}
+
+func (ir *inputReader) ReadByte() (byte, error) {
+	if ir.br != nil {
+		return ir.br.ReadByte()
+	}
+	for ir.i == ir.n {
+		n, err := ir.r.Read(ir.buf)
+		ir.i, ir.n = 0, n
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+	b := ir.buf[ir.i]
+	ir.i++
+	return b, nil
+}
+
+// Close gives back any input that was read but not consumed
+func (ir *inputReader) Close() error {
+	if ir.seek == nil || ir.i == ir.n {
+		return nil
+	}
+	_, err := ir.seek.Seek(int64(ir.i-ir.n), io.SeekCurrent)
+	ir.i = ir.n
+	return err
+}
+
+// deadlineFile returns a file reading from f whose reads fail with
+// os.ErrDeadlineExceeded after the deadline d, and a function to call once
+// done with it.  Terminals and other files not opened in non-blocking mode
+// don’t support deadlines, so we read from a non-blocking duplicate of the
+// file descriptor instead.  Reads from regular files never block, so those
+// are read without a deadline.
+func deadlineFile(f *os.File, d time.Time) (*os.File, func(), error) {
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return f, func() {}, nil
+	}
+
+	err := f.SetReadDeadline(d)
+	switch {
+	case err == nil:
+		return f, func() { f.SetReadDeadline(time.Time{}) }, nil
+	case !errors.Is(err, os.ErrNoDeadline):
+		return nil, nil, err
+	}
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	g := os.NewFile(uintptr(fd), f.Name())
+	done := func() {
+		// The duplicate shares its flags with f
+		syscall.SetNonblock(fd, false)
+		g.Close()
+	}
+	switch err := g.SetReadDeadline(d); {
+	case errors.Is(err, os.ErrNoDeadline):
+		// Not pollable, like regular files
+		done()
+		return f, func() {}, nil
+	case err != nil:
+		done()
+		return nil, nil, err
+	}
+	return g, done, nil
+}
+
+// noEcho turns off echoing of input on the terminal f, returning a function
+// to turn it back on.  If f isn’t a terminal it does nothing.
+func noEcho(f *os.File) func() {
+	var t syscall.Termios
+	if ioctlTermios(f, ioctlGetTermios, &t) != nil {
+		return func() {}
+	}
+	old := t
+	t.Lflag &^= syscall.ECHO
+	if ioctlTermios(f, ioctlSetTermios, &t) != nil {
+		return func() {}
+	}
+	return func() { ioctlTermios(f, ioctlSetTermios, &old) }
+}
+
+// ioctlTermios gets or sets the terminal attributes of f.  Unlike f.Fd(),
+// this doesn’t put f into blocking mode.
+func ioctlTermios(f *os.File, req uint, t *syscall.Termios) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req),
+			uintptr(unsafe.Pointer(t)))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
-package main
+package andy
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 )
@@ -31,3 +32,19 @@ var signals = map[string]os.Signal{
 	"sigxcpu": syscall.SIGXCPU,
 	"sigxfsz": syscall.SIGXFSZ,
 }
+
+// signalName returns the name of sig in the signals table.  Of signals with
+// multiple names the alphabetically first is used, so that we name the same
+// signal the same way on every run.
+func signalName(sig syscall.Signal) string {
+	var name string
+	for k, v := range signals {
+		if v == sig && (name == "" || k < name) {
+			name = k
+		}
+	}
+	if name == "" {
+		return fmt.Sprintf("sig%d", int(sig))
+	}
+	return name
+}
@@ -0,0 +1,86 @@
+package andy
+
+import (
+	"errors"
+	"slices"
+
+	"git.sr.ht/~mango/andy/pkg/stringsx"
+	"git.sr.ht/~mango/opts/v2"
+)
+
+// splitFlags are the flags controlling how text is split into fields.  They
+// are accepted both by the ‘split’ builtin and at the start of the separators
+// of a process substitution, where they must be followed by ‘--’.
+var splitFlags = []Flag{
+	{
+		Short: 'D',
+		Long:  "no-empty",
+		Help:  "discard empty fields",
+	},
+	{
+		Short: 'e',
+		Long:  "empty",
+		Help:  "keep all empty fields, including a trailing one",
+	},
+	{
+		Short: 'r',
+		Long:  "regexp",
+		Help:  "treat separators as regular expressions",
+	},
+}
+
+var errSplitFlags = errors.New("the ‘-D’ and ‘-e’ flags are mutually exclusive")
+
+// newSplitter returns a splitter splitting on seps as configured by flags
+func newSplitter(flags []opts.Flag, seps []string) (*stringsx.Splitter, error) {
+	var empty stringsx.EmptyFields
+	var regexp bool
+	for _, f := range flags {
+		switch f.Key {
+		case 'D', 'e':
+			mode := stringsx.DropEmpty
+			if f.Key == 'e' {
+				mode = stringsx.KeepEmpty
+			}
+			if empty != stringsx.KeepInner && empty != mode {
+				return nil, errSplitFlags
+			}
+			empty = mode
+		case 'r':
+			regexp = true
+		}
+	}
+
+	sp := stringsx.NewSplitter(seps)
+	if regexp {
+		var err error
+		if sp, err = stringsx.NewRegexpSplitter(seps); err != nil {
+			return nil, err
+		}
+	}
+	sp.Empty = empty
+	return sp, nil
+}
+
+// procSubSplitter returns the splitter for a process substitution with the
+// separators seps.  Flags from splitFlags may come before the separators if
+// they are followed by ‘--’, as in ‘`(-r -- '\s+')’.  Otherwise every
+// argument is a separator, so that separators such as ‘-D’ and ‘--’ don’t
+// change meaning.  Unlike other separators, regular expressions need all of
+// the output of the process substitution before they can split it.
+func procSubSplitter(seps []string) (*stringsx.Splitter, error) {
+	i := slices.Index(seps, "--")
+	if i <= 0 {
+		return stringsx.NewSplitter(seps), nil
+	}
+
+	los := make([]opts.LongOpt, len(splitFlags))
+	for i, f := range splitFlags {
+		los[i] = opts.LongOpt{Short: f.Short, Long: f.Long, Arg: f.Arg}
+	}
+	flags, rest, err := opts.GetLong(append([]string{"`"}, seps[:i]...), los)
+	if err != nil || len(rest) > 0 {
+		return stringsx.NewSplitter(seps), nil
+	}
+	return newSplitter(flags, seps[i+1:])
+}
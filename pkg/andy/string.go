@@ -0,0 +1,474 @@
+package andy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"git.sr.ht/~mango/opts/v2"
+)
+
+// The subcommands of the ‘string’ builtin.  Each operates on its string
+// arguments, or the lines of its standard input if there are none, and
+// prints its results one per line so that they can be read back as a list.
+var stringCmds = []*Builtin{
+	{
+		Name:    "escape",
+		Usage:   []string{"string escape [string ...]"},
+		MaxArgs: Unlimited,
+		Run:     cmdStringEscape,
+	},
+	{
+		Name:    "join",
+		Usage:   []string{"string join separator [string ...]"},
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Run:     cmdStringJoin,
+	},
+	{
+		Name:    "length",
+		Usage:   []string{"string length [string ...]"},
+		MaxArgs: Unlimited,
+		Run:     cmdStringLength,
+	},
+	{
+		Name:    "lower",
+		Usage:   []string{"string lower [string ...]"},
+		MaxArgs: Unlimited,
+		Run:     cmdStringLower,
+	},
+	{
+		Name:  "match",
+		Usage: []string{"string match [-irv] pattern [string ...]"},
+		Flags: []Flag{
+			{
+				Short: 'i',
+				Long:  "ignore-case",
+				Help:  "match case-insensitively",
+			},
+			{
+				Short: 'r',
+				Long:  "regexp",
+				Help:  "treat ‘pattern’ as a regular expression and print its capture groups",
+			},
+			{
+				Short: 'v',
+				Long:  "invert",
+				Help:  "print the strings that don’t match",
+			},
+		},
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Run:     cmdStringMatch,
+	},
+	{
+		Name:  "pad",
+		Usage: []string{"string pad [-r] [-c char] [-w width] [string ...]"},
+		Flags: []Flag{
+			{
+				Short: 'c',
+				Long:  "char",
+				Arg:   opts.Required,
+				Value: "char",
+				Help:  "pad with ‘char’ instead of spaces",
+			},
+			{
+				Short: 'r',
+				Long:  "right",
+				Help:  "pad on the right instead of the left",
+			},
+			{
+				Short: 'w',
+				Long:  "width",
+				Arg:   opts.Required,
+				Value: "width",
+				Help:  "pad to ‘width’ characters instead of the longest string",
+			},
+		},
+		MaxArgs: Unlimited,
+		Run:     cmdStringPad,
+	},
+	{
+		Name:    "repeat",
+		Usage:   []string{"string repeat count [string ...]"},
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Run:     cmdStringRepeat,
+	},
+	{
+		Name:  "replace",
+		Usage: []string{"string replace [-air] pattern replacement [string ...]"},
+		Flags: []Flag{
+			{
+				Short: 'a',
+				Long:  "all",
+				Help:  "replace every match instead of only the first",
+			},
+			{
+				Short: 'i',
+				Long:  "ignore-case",
+				Help:  "match case-insensitively",
+			},
+			{
+				Short: 'r',
+				Long:  "regexp",
+				Help:  "treat ‘pattern’ as a regular expression",
+			},
+		},
+		MinArgs: 2,
+		MaxArgs: Unlimited,
+		Run:     cmdStringReplace,
+	},
+	{
+		Name:  "split",
+		Usage: []string{"string split [-n max] separator [string ...]"},
+		Flags: []Flag{{
+			Short: 'n',
+			Long:  "max",
+			Arg:   opts.Required,
+			Value: "max",
+			Help:  "split each string into at most ‘max’ fields",
+		}},
+		MinArgs: 1,
+		MaxArgs: Unlimited,
+		Run:     cmdStringSplit,
+	},
+	{
+		Name:  "sub",
+		Usage: []string{"string sub [-l length] [-s start] [string ...]"},
+		Flags: []Flag{
+			{
+				Short: 'l',
+				Long:  "length",
+				Arg:   opts.Required,
+				Value: "length",
+				Help:  "print at most ‘length’ characters",
+			},
+			{
+				Short: 's',
+				Long:  "start",
+				Arg:   opts.Required,
+				Value: "start",
+				Help:  "start at the character with index ‘start’",
+			},
+		},
+		MaxArgs: Unlimited,
+		Run:     cmdStringSub,
+	},
+	{
+		Name:  "trim",
+		Usage: []string{"string trim [-lr] [-c chars] [string ...]"},
+		Flags: []Flag{
+			{
+				Short: 'c',
+				Long:  "chars",
+				Arg:   opts.Required,
+				Value: "chars",
+				Help:  "trim the characters in ‘chars’ instead of whitespace",
+			},
+			{
+				Short: 'l',
+				Long:  "left",
+				Help:  "only trim the start of each string",
+			},
+			{
+				Short: 'r',
+				Long:  "right",
+				Help:  "only trim the end of each string",
+			},
+		},
+		MaxArgs: Unlimited,
+		Run:     cmdStringTrim,
+	},
+	{
+		Name:    "upper",
+		Usage:   []string{"string upper [string ...]"},
+		MaxArgs: Unlimited,
+		Run:     cmdStringUpper,
+	},
+}
+
+func stringUsage() []string {
+	var xs []string
+	for _, b := range stringCmds {
+		xs = append(xs, b.Usage...)
+	}
+	return xs
+}
+
+func cmdString(c *Call) uint8 {
+	switch {
+	case len(c.Args) == 0:
+		return c.Usage()
+	case c.Args[0] == "--help":
+		c.builtin.usage(c.Stdout)
+		return 0
+	}
+	for _, b := range stringCmds {
+		if b.Name == c.Args[0] {
+			cmd := exec.Cmd{
+				Args:   append([]string{"string " + b.Name}, c.Args[1:]...),
+				Stdin:  c.Stdin,
+				Stdout: c.Stdout,
+				Stderr: c.Stderr,
+			}
+			return b.call(&cmd, c.ctx)
+		}
+	}
+	c.Errorf("unknown subcommand ‘%s’", c.Args[0])
+	return c.Usage()
+}
+
+// stringArgs returns the strings operated on by a subcommand of ‘string’; the
+// arguments from i onwards, or the lines of standard input if there are none
+func stringArgs(c *Call, i int) ([]string, error) {
+	if len(c.Args) > i {
+		return c.Args[i:], nil
+	}
+
+	var xs []string
+	r := bufio.NewReader(c.Stdin)
+	for {
+		s, err := r.ReadString('\n')
+		if s != "" {
+			xs = append(xs, strings.TrimSuffix(s, "\n"))
+		}
+		if err == io.EOF {
+			return xs, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mapStrings prints the result of calling f on each of the strings operated
+// on by a subcommand of ‘string’
+func mapStrings(c *Call, i int, f func(string) string) uint8 {
+	xs, err := stringArgs(c, i)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	for _, x := range xs {
+		fmt.Fprintln(c.Stdout, f(x))
+	}
+	return 0
+}
+
+func cmdStringEscape(c *Call) uint8 {
+	return mapStrings(c, 0, rawString)
+}
+
+func cmdStringJoin(c *Call) uint8 {
+	xs, err := stringArgs(c, 1)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	fmt.Fprintln(c.Stdout, strings.Join(xs, c.Args[0]))
+	return 0
+}
+
+func cmdStringLength(c *Call) uint8 {
+	return mapStrings(c, 0, func(s string) string {
+		return strconv.Itoa(utf8.RuneCountInString(s))
+	})
+}
+
+func cmdStringLower(c *Call) uint8 {
+	return mapStrings(c, 0, strings.ToLower)
+}
+
+func cmdStringUpper(c *Call) uint8 {
+	return mapStrings(c, 0, strings.ToUpper)
+}
+
+func cmdStringMatch(c *Call) uint8 {
+	var re *regexp.Regexp
+	var err error
+	if c.Has('r') {
+		if c.Has('i') {
+			re, err = regexp.Compile("(?i)" + c.Args[0])
+		} else {
+			re, err = regexp.Compile(c.Args[0])
+		}
+	} else {
+		re, err = compileGlob(c.Args[0], c.Has('i'))
+	}
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+
+	xs, err := stringArgs(c, 1)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+
+	var code uint8 = 1
+	for _, x := range xs {
+		m := re.FindStringSubmatch(x)
+		switch {
+		case (m == nil) != c.Has('v'):
+			continue
+		case m == nil || !c.Has('r'):
+			fmt.Fprintln(c.Stdout, x)
+		default:
+			for _, s := range m {
+				fmt.Fprintln(c.Stdout, s)
+			}
+		}
+		code = 0
+	}
+	return code
+}
+
+func cmdStringPad(c *Call) uint8 {
+	pad := " "
+	if s, ok := c.Flag('c'); ok {
+		if utf8.RuneCountInString(s) != 1 {
+			return c.Errorf("‘%s’ isn’t a single character", s)
+		}
+		pad = s
+	}
+
+	xs, err := stringArgs(c, 0)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+
+	w := 0
+	if s, ok := c.Flag('w'); ok {
+		if w, err = strconv.Atoi(s); err != nil || w < 0 {
+			return c.Errorf("‘%s’ isn’t a valid width", s)
+		}
+	} else {
+		for _, x := range xs {
+			w = max(w, utf8.RuneCountInString(x))
+		}
+	}
+
+	for _, x := range xs {
+		p := strings.Repeat(pad, max(w-utf8.RuneCountInString(x), 0))
+		if c.Has('r') {
+			fmt.Fprintln(c.Stdout, x+p)
+		} else {
+			fmt.Fprintln(c.Stdout, p+x)
+		}
+	}
+	return 0
+}
+
+func cmdStringRepeat(c *Call) uint8 {
+	n, err := strconv.Atoi(c.Args[0])
+	if err != nil || n < 0 {
+		return c.Errorf("‘%s’ isn’t a valid count", c.Args[0])
+	}
+	return mapStrings(c, 1, func(s string) string {
+		return strings.Repeat(s, n)
+	})
+}
+
+func cmdStringReplace(c *Call) uint8 {
+	pat, repl := c.Args[0], c.Args[1]
+	if !c.Has('r') {
+		pat, repl = regexp.QuoteMeta(pat), strings.ReplaceAll(repl, "$", "$$")
+	}
+	if c.Has('i') {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+
+	var code uint8 = 1
+	res := mapStrings(c, 2, func(s string) string {
+		m := re.FindStringSubmatchIndex(s)
+		if m == nil {
+			return s
+		}
+		code = 0
+		if c.Has('a') {
+			return re.ReplaceAllString(s, repl)
+		}
+		return s[:m[0]] + string(re.ExpandString(nil, repl, s, m)) + s[m[1]:]
+	})
+	if res != 0 {
+		return res
+	}
+	return code
+}
+
+func cmdStringSplit(c *Call) uint8 {
+	n := -1
+	if s, ok := c.Flag('n'); ok {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			return c.Errorf("‘%s’ isn’t a valid number of fields", s)
+		}
+	}
+
+	xs, err := stringArgs(c, 1)
+	if err != nil {
+		return c.Errorf("%s", err)
+	}
+	for _, x := range xs {
+		for _, s := range strings.SplitN(x, c.Args[0], n) {
+			fmt.Fprintln(c.Stdout, s)
+		}
+	}
+	return 0
+}
+
+func cmdStringSub(c *Call) uint8 {
+	start, length := 0, -1
+	if s, ok := c.Flag('s'); ok {
+		n, res := stoi(s)
+		if cmdFailed(res) {
+			return c.Errorf("%s", res)
+		}
+		start = n
+	}
+	if s, ok := c.Flag('l'); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return c.Errorf("‘%s’ isn’t a valid length", s)
+		}
+		length = n
+	}
+
+	return mapStrings(c, 0, func(s string) string {
+		rs := []rune(s)
+		i := start
+		if i < 0 {
+			i = max(i+len(rs), 0)
+		}
+		i = min(i, len(rs))
+		j := len(rs)
+		if length != -1 {
+			j = min(i+length, j)
+		}
+		return string(rs[i:j])
+	})
+}
+
+func cmdStringTrim(c *Call) uint8 {
+	trim := func(r rune) bool { return unicode.IsSpace(r) }
+	if s, ok := c.Flag('c'); ok {
+		trim = func(r rune) bool { return strings.ContainsRune(s, r) }
+	}
+	lflag, rflag := c.Has('l'), c.Has('r')
+	return mapStrings(c, 0, func(s string) string {
+		if lflag || !rflag {
+			s = strings.TrimLeftFunc(s, trim)
+		}
+		if rflag || !lflag {
+			s = strings.TrimRightFunc(s, trim)
+		}
+		return s
+	})
+}
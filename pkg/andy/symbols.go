@@ -0,0 +1,178 @@
+package andy
+
+import (
+	"slices"
+	"strings"
+)
+
+// A SymbolKind is the kind of a Symbol
+type SymbolKind int
+
+const (
+	FuncSymbol SymbolKind = iota
+	VarSymbol
+)
+
+// A Symbol is a definition of or a reference to a function or variable in
+// Andy source code.  Lines and columns start at 1, and columns are counted in
+// bytes.  References to functions include calls of builtins and external
+// commands.
+type Symbol struct {
+	Name      string
+	Kind      SymbolKind
+	Line, Col int
+
+	// For function definitions, the position of the closing brace of the
+	// function body
+	EndLine, EndCol int
+
+	// For function definitions, the names of the arguments
+	Args []string
+}
+
+// An Outline lists the symbols defined and referenced in a script, in the
+// order they appear in the source code
+type Outline struct {
+	Defs, Refs []Symbol
+}
+
+// Symbols parses the Andy source code in src and returns its outline.  Only
+// functions and variables whose names are known without running the code are
+// included.
+func Symbols(name, src string) (Outline, error) {
+	prog, _, err := parse(name, src)
+	if err != nil {
+		return Outline{}, err
+	}
+
+	var o Outline
+	lines := strings.Split(src, "\n")
+	add := func(xs *[]Symbol, s Symbol, pos position) position {
+		pos = findName(lines, pos, s.Name)
+		s.Line, s.Col = pos.line, pos.col
+		*xs = append(*xs, s)
+		pos.col += len(s.Name)
+		return pos
+	}
+
+	inspect(prog, func(n any) {
+		switch n := n.(type) {
+		case astFuncDef:
+			xs, ok := staticValues(n.args)
+			if !ok {
+				return
+			}
+			pos := n.pos
+			pos.col += len("func")
+			pos = add(&o.Defs, Symbol{
+				Name:    xs[0],
+				Kind:    FuncSymbol,
+				EndLine: n.end.line,
+				EndCol:  n.end.col,
+				Args:    xs[1:],
+			}, pos)
+			for _, x := range xs[1:] {
+				pos = add(&o.Defs, Symbol{Name: x, Kind: VarSymbol}, pos)
+			}
+		case astCleanCommand:
+			switch cmd := n.cmd.(type) {
+			case *astFor:
+				xs, ok := staticValues([]astValue{cmd.bind})
+				if ok && len(xs) == 1 {
+					pos := n.pos
+					pos.col += len("for")
+					add(&o.Defs, Symbol{Name: xs[0], Kind: VarSymbol}, pos)
+				}
+			case *astSimple:
+				args, ok := staticValues(cmd.args)
+				if !ok {
+					args, ok = staticValues(cmd.args[:1])
+				}
+				if !ok {
+					return
+				}
+				pos := add(&o.Refs, Symbol{Name: args[0], Kind: FuncSymbol}, n.pos)
+				for _, v := range assignedVars(args) {
+					pos = add(&o.Defs, Symbol{Name: v, Kind: VarSymbol}, pos)
+				}
+			}
+		case astVarRef:
+			if xs, ok := staticValues([]astValue{n.ident}); ok && len(xs) == 1 {
+				add(&o.Refs, Symbol{Name: xs[0], Kind: VarSymbol}, n.pos)
+			}
+		}
+	})
+
+	// Commands are visited before the values in them, so restore the source
+	// order
+	for _, xs := range [][]Symbol{o.Defs, o.Refs} {
+		slices.SortStableFunc(xs, func(a, b Symbol) int {
+			if a.Line != b.Line {
+				return a.Line - b.Line
+			}
+			return a.Col - b.Col
+		})
+	}
+	return o, nil
+}
+
+// Definition returns the definition the reference ref refers to.  For
+// variables this is the last definition before the reference, or the first
+// definition if there is none.
+func (o Outline) Definition(ref Symbol) (Symbol, bool) {
+	var def Symbol
+	var found bool
+	for _, d := range o.Defs {
+		if d.Name != ref.Name || d.Kind != ref.Kind {
+			continue
+		}
+		before := d.Line < ref.Line || d.Line == ref.Line && d.Col <= ref.Col
+		if !found || before && ref.Kind == VarSymbol {
+			def, found = d, true
+		}
+		if !before {
+			break
+		}
+	}
+	return def, found
+}
+
+// At returns the symbol that covers the given position, if any
+func (o Outline) At(line, col int) (Symbol, bool) {
+	for _, xs := range [][]Symbol{o.Refs, o.Defs} {
+		for _, s := range xs {
+			if s.Line == line && s.Col <= col && col < s.Col+len(s.Name) {
+				return s, true
+			}
+		}
+	}
+	return Symbol{}, false
+}
+
+// findName returns the position of the first occurrence of name as a whole
+// word at or after pos.  If it can’t be found, pos is returned as-is.
+func findName(lines []string, pos position, name string) position {
+	if pos.line < 1 || pos.line > len(lines) || pos.col < 1 {
+		return pos
+	}
+	line := lines[pos.line-1]
+	for i := min(pos.col-1, len(line)); i < len(line); {
+		j := strings.Index(line[i:], name)
+		if j == -1 {
+			break
+		}
+		j += i
+		end := j + len(name)
+		if (j == 0 || !isWordByte(line[j-1])) &&
+			(end == len(line) || !isWordByte(line[end])) {
+			pos.col = j + 1
+			return pos
+		}
+		i = j + 1
+	}
+	return pos
+}
+
+func isWordByte(b byte) bool {
+	return b >= 0x80 || isRefRune(rune(b)) || b == '-'
+}
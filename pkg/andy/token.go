@@ -1,4 +1,4 @@
-package main
+package andy
 
 import "fmt"
 
@@ -11,6 +11,7 @@ const (
 	tokEof
 
 	tokArg
+	tokArith
 	tokColon
 	tokConcat
 	tokString
@@ -44,6 +45,22 @@ const (
 type token struct {
 	kind tokenKind
 	val  string
+	pos  position
+}
+
+// A position is a location in source code.  Lines and columns start at 1, and
+// columns are counted in bytes.
+type position struct {
+	file      string
+	line, col int
+}
+
+func (p position) String() string {
+	s := fmt.Sprintf("%d:%d", p.line, p.col)
+	if p.file != "" {
+		s = p.file + ":" + s
+	}
+	return s
 }
 
 const maxStrLen = 20
@@ -63,6 +80,8 @@ func (t token) String() string {
 			return fmt.Sprintf("‘%.*s…’", maxStrLen, t.val)
 		}
 		return "‘" + t.val + "’"
+	case tokArith:
+		return fmt.Sprintf("‘$[%s]’", t.val)
 	case tokColon:
 		return ":"
 	case tokConcat:
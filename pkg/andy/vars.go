@@ -0,0 +1,200 @@
+package andy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A mapVar is the value of a map variable.  Scopes are copied when calling
+// functions and running loops, so a map shared between scopes is copied the
+// first time it is written to.
+type mapVar struct {
+	m      map[string][]string
+	shared bool
+}
+
+func (mv *mapVar) keys() []string {
+	ks := make([]string, 0, len(mv.m))
+	for k := range mv.m {
+		ks = append(ks, k)
+	}
+	slices.Sort(ks)
+	return ks
+}
+
+// index returns the values of the keys in ks.  Missing keys have no values,
+// and neither does a nil map.
+func (mv *mapVar) index(ks []string) []string {
+	xs := []string{}
+	if mv == nil {
+		return xs
+	}
+	for _, k := range ks {
+		xs = append(xs, mv.m[k]...)
+	}
+	return xs
+}
+
+// shareMaps returns a copy of the map variables ms for use in a new scope
+func shareMaps(ms map[string]*mapVar) map[string]*mapVar {
+	ys := make(map[string]*mapVar, len(ms))
+	for k, mv := range ms {
+		mv.shared = true
+		ys[k] = &mapVar{mv.m, true}
+	}
+	return ys
+}
+
+// splitMapRef splits a reference to an element of a map such as ‘m[key]’
+// into the name of the map and the key
+func splitMapRef(ident string) (name, key string, ok bool) {
+	i := strings.IndexByte(ident, '[')
+	if i == -1 || !strings.HasSuffix(ident, "]") {
+		return ident, "", false
+	}
+	return ident[:i], ident[i+1 : len(ident)-1], true
+}
+
+// lookupMap returns the map variable ident if it is visible in ctx and is
+// not hidden by a list of the same name
+func lookupMap(ctx context, ident string) (*mapVar, bool) {
+	if _, ok := ctx.scope[ident]; ok {
+		return nil, false
+	}
+	if mv, ok := ctx.maps[ident]; ok {
+		return mv, true
+	}
+	if _, ok := ctx.sh.vars[ident]; ok {
+		return nil, false
+	}
+	mv, ok := ctx.sh.maps[ident]
+	return mv, ok
+}
+
+// lookupMaps returns the map variables of the scope that lookupScope() would
+// return
+func lookupMaps(ctx context, global bool) map[string]*mapVar {
+	if global || ctx.scope == nil {
+		return ctx.sh.maps
+	}
+	return ctx.maps
+}
+
+// visibleVar returns the variable name as seen from the scope that
+// lookupScope() would return.  If the variable is a list, ok is true.
+func visibleVar(ctx context, name string, global bool) (xs []string, mv *mapVar, ok bool) {
+	if !global && ctx.scope != nil {
+		if xs, ok := ctx.scope[name]; ok {
+			return xs, nil, true
+		}
+		if mv, ok := ctx.maps[name]; ok {
+			return nil, mv, false
+		}
+	}
+	if xs, ok := ctx.sh.vars[name]; ok {
+		return xs, nil, true
+	}
+	return nil, ctx.sh.maps[name], false
+}
+
+// varValue returns the value of ident as seen by ‘set’, where ident may refer
+// to the elements of a list or map
+func varValue(ctx context, ident string, global bool) ([]string, error) {
+	name, key, isRef := splitMapRef(ident)
+	xs, mv, ok := visibleVar(ctx, name, global)
+	switch {
+	case isRef && ok:
+		xs, res := indexList(xs, []string{key})
+		if cmdFailed(res) {
+			return nil, res
+		}
+		return xs, nil
+	case isRef:
+		return mv.index([]string{key}), nil
+	case ok:
+		return xs, nil
+	case mv != nil:
+		return mv.keys(), nil
+	}
+	return nil, nil
+}
+
+// spliceList returns a copy of xs with the elements selected by the index or
+// range s replaced by vals.  Indices are the same as those of indexList(),
+// except that ranges can’t be reversed.  An empty range such as ‘2..2’
+// inserts vals before the element it starts at.
+func spliceList(xs []string, s string, vals []string) ([]string, error) {
+	n := len(xs)
+	i, j, res := getIndexRange(s, n)
+	if cmdFailed(res) {
+		return nil, res
+	}
+	if i > j {
+		return nil, fmt.Errorf("can’t assign to the reversed range ‘%s’", s)
+	}
+
+	// Ranges such as ‘-2..0’ select the end of the list
+	I, J := i, j
+	if I < 0 {
+		I += n
+	}
+	if J < 0 || J == 0 && i < 0 {
+		J += n
+	}
+	switch {
+	case I < 0, I > n, I == n && j > i:
+		return nil, errInvalidIndex{i, n}
+	case J < I, J > n:
+		return nil, errInvalidIndex{j, n}
+	}
+
+	ys := make([]string, 0, n-(J-I)+len(vals))
+	ys = append(ys, xs[:I]...)
+	ys = append(ys, vals...)
+	return append(ys, xs[J:]...), nil
+}
+
+// ownMap returns the map variable name of the scope that lookupMaps() would
+// return, ready to be written to.  Like lists, a map visible from an outer
+// scope is copied into this one.
+func ownMap(ctx context, name string, global bool, visible *mapVar) *mapVar {
+	ms := lookupMaps(ctx, global)
+	if mv, ok := ms[name]; ok && !mv.shared {
+		return mv
+	}
+	mv := &mapVar{m: make(map[string][]string)}
+	if visible != nil {
+		mv.m = maps.Clone(visible.m)
+	}
+	ms[name] = mv
+	return mv
+}
+
+// setMapKey sets the element key of the visible map variable name to vals,
+// creating the map if it doesn’t exist
+func setMapKey(ctx context, name, key string, global bool, visible *mapVar, vals []string) {
+	ownMap(ctx, name, global, visible).m[key] = vals
+}
+
+// unsetMapKey removes the element key from the visible map variable name.
+// Maps are removed entirely once they are empty, unless that would reveal a
+// variable of the same name in an outer scope.
+func unsetMapKey(ctx context, name, key string, global bool, visible *mapVar) {
+	if visible == nil {
+		return
+	}
+	if _, ok := visible.m[key]; !ok {
+		return
+	}
+	mv := ownMap(ctx, name, global, visible)
+	if delete(mv.m, key); len(mv.m) > 0 {
+		return
+	}
+	ms := lookupMaps(ctx, global)
+	delete(ms, name)
+	if _, outer, ok := visibleVar(ctx, name, global); ok || outer != nil {
+		ms[name] = mv
+	}
+}
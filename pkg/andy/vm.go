@@ -0,0 +1,508 @@
+package andy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"git.sr.ht/~mango/andy/pkg/stack"
+	"git.sr.ht/~mango/andy/pkg/stringsx"
+)
+
+type context struct {
+	in       io.Reader
+	out, err io.Writer
+	scope    map[string][]string
+	maps     map[string]*mapVar
+	wd       *workDir
+	exit     *exitState
+	sh       *Interpreter
+
+	// Only code running in the foreground handles signals; not async
+	// commands, the earlier commands of pipelines, or process redirections
+	fg bool
+
+	// Cleanup code such as deferred commands and the exit hook runs to
+	// completion even if the interpreter was interrupted
+	masked bool
+}
+
+// resolve returns path relative to the working directory of the context
+func (ctx context) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(ctx.wd.cwd, path)
+}
+
+// A workDir is the working directory of a context, along with its directory
+// stack.  We track this ourselves instead of using os.Chdir() so that
+// concurrently running code doesn’t change directory from underneath us.
+type workDir struct {
+	cwd   string
+	stack stack.Stack[string]
+}
+
+func (wd *workDir) fork() *workDir {
+	return &workDir{wd.cwd, slices.Clone(wd.stack)}
+}
+
+// An exitState records a call to ‘exit’, after which the code sharing it
+// stops at its next command.  Async commands, the earlier commands of
+// pipelines, and process substitutions and redirections get states of their
+// own, so that exiting them doesn’t exit the shell, but they also stop once
+// the shell exits.
+type exitState struct {
+	parent *exitState
+	code   atomic.Int32 // The exit code plus one, or 0 if there was no exit
+}
+
+func (es *exitState) fork() *exitState {
+	return &exitState{parent: es}
+}
+
+// set records the exit code n, unless one was already recorded
+func (es *exitState) set(n uint8) {
+	es.code.CompareAndSwap(0, int32(n)+1)
+}
+
+// result returns the result of code stopped by a call to ‘exit’, or nil if
+// there was none
+func (es *exitState) result() commandResult {
+	for ; es != nil; es = es.parent {
+		if n := es.code.Load(); n > 0 {
+			return errExit(n - 1)
+		}
+	}
+	return nil
+}
+
+type function struct {
+	args []string
+	body astProgram
+	code *chunk
+	pos  position
+}
+
+// A vm runs a single chunk of compiled code.  Code that runs in a different
+// context — function bodies, process substitutions, and the commands of a
+// pipeline — gets a vm of its own.
+type vm struct {
+	ctx context
+	res commandResult
+
+	stack [][]string
+	pc    int
+
+	// Where to jump to if evaluating the values of the current command fails
+	failTo int
+
+	// The pipes of process redirections used by the current command
+	files []*os.File
+
+	saved  []savedStreams
+	loops  []forLoop
+	defers []*chunk
+}
+
+type savedStreams struct {
+	in    io.Reader
+	out   io.Writer
+	files []io.Closer
+}
+
+type forLoop struct {
+	bind  string
+	vals  []string
+	scope map[string][]string
+	maps  map[string]*mapVar
+	files []*os.File
+}
+
+// run executes c in ctx and returns the result of the last command run
+func run(c *chunk, ctx context) commandResult {
+	vm := vm{ctx: ctx, res: errExitCode(0)}
+	return vm.run(c)
+}
+
+// runAll runs each chunk in cs in turn until one of them fails
+func runAll(cs []*chunk, ctx context) commandResult {
+	for _, c := range cs {
+		if res := run(c, ctx); cmdFailed(res) {
+			return res
+		}
+	}
+	return errExitCode(0)
+}
+
+func (vm *vm) push(xs []string) {
+	vm.stack = append(vm.stack, xs)
+}
+
+func (vm *vm) pop() []string {
+	xs := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return xs
+}
+
+func (vm *vm) top() []string {
+	return vm.stack[len(vm.stack)-1]
+}
+
+// fail aborts the current command with the result res
+func (vm *vm) fail(res commandResult) {
+	vm.res = res
+	vm.stack = vm.stack[:0]
+	closeFiles(vm.files)
+	vm.files = nil
+	vm.pc = vm.failTo
+}
+
+// takeFiles returns the pipes of process redirections used by the current
+// command, making the caller responsible for closing them
+func (vm *vm) takeFiles() []*os.File {
+	xs := vm.files
+	vm.files = nil
+	return xs
+}
+
+func (vm *vm) run(c *chunk) commandResult {
+	for vm.pc < len(c.code) {
+		in := c.code[vm.pc]
+		vm.pc++
+
+		switch in.op {
+		case opConst:
+			vm.push(c.consts[in.arg])
+		case opTilde:
+			s, err := tildeExpand(c.consts[in.arg][0])
+			if err != nil {
+				vm.fail(errInternal{err})
+				break
+			}
+			vm.push([]string{s})
+		case opVar:
+			vm.push(lookupVar(vm.ctx, c.consts[in.arg][0]))
+		case opVarDyn:
+			switch ss := vm.pop(); {
+			case len(ss) > 2:
+				vm.fail(errInternal{errors.New("not implemented")})
+			case len(ss) == 0:
+				vm.push([]string{})
+				vm.pc = int(in.arg)
+			default:
+				vm.push(lookupVar(vm.ctx, ss[0]))
+			}
+		case opVarName:
+			switch ss := vm.top(); {
+			case len(ss) > 2:
+				vm.fail(errInternal{errors.New("not implemented")})
+			case len(ss) == 0:
+				vm.pc = int(in.arg)
+			}
+		case opVarMap:
+			name := vm.top()[0]
+			if _, ok := lookupMap(vm.ctx, name); ok {
+				vm.pc = int(in.arg)
+				break
+			}
+			vm.pop()
+			vm.push(lookupVar(vm.ctx, name))
+		case opDefault:
+			if xs := vm.top(); len(xs) == 0 || xs[0] == "" {
+				vm.pop()
+			} else {
+				vm.pc = int(in.arg)
+			}
+		case opIndex:
+			ss := vm.pop()
+			xs, res := indexList(vm.pop(), ss)
+			if cmdFailed(res) {
+				vm.fail(res)
+				break
+			}
+			vm.push(xs)
+		case opMapIndex:
+			ks := vm.pop()
+			mv, _ := lookupMap(vm.ctx, vm.pop()[0])
+			vm.push(mv.index(ks))
+		case opFlatten:
+			vm.push([]string{strings.Join(vm.pop(), " ")})
+		case opLength:
+			vm.push([]string{strconv.Itoa(len(vm.pop()))})
+		case opConcat:
+			ys := vm.pop()
+			vm.push(product(vm.pop(), ys))
+		case opList:
+			n := len(vm.stack) - int(in.arg)
+			var xs []string
+			for _, ys := range vm.stack[n:] {
+				xs = append(xs, ys...)
+			}
+			vm.stack = vm.stack[:n]
+			vm.push(xs)
+		case opArith:
+			n, err := c.exprs[in.arg].eval(func(name string) []string {
+				return lookupVar(vm.ctx, name)
+			})
+			if err != nil {
+				vm.fail(errInternal{err})
+				break
+			}
+			vm.push([]string{n.String()})
+		case opProcSub:
+			xs, res := procSub(c.chunks[in.arg], vm.pop(), vm.ctx)
+			if cmdFailed(res) {
+				vm.fail(res)
+				break
+			}
+			vm.push(xs)
+		case opProcRead, opProcWrite, opProcRdWr:
+			kind := procRead | procWrite
+			switch in.op {
+			case opProcRead:
+				kind = procRead
+			case opProcWrite:
+				kind = procWrite
+			}
+			xs, files, res := procRedir(c.chunks[in.arg], kind, vm.ctx)
+			if cmdFailed(res) {
+				vm.fail(res)
+				break
+			}
+			vm.files = append(vm.files, files...)
+			vm.push(xs)
+
+		case opBegin:
+			vm.failTo = int(in.arg)
+			if vm.ctx.masked {
+				break
+			}
+			switch res := vm.ctx.exit.result(); {
+			case res != nil:
+				vm.fail(res)
+			case vm.ctx.sh.interrupted.Load():
+				vm.fail(errInterrupted)
+			}
+		case opSimple:
+			n := len(vm.stack) - int(in.arg)
+			var args []string
+			for _, xs := range vm.stack[n:] {
+				args = append(args, xs...)
+			}
+			vm.stack = vm.stack[:n]
+			files := vm.takeFiles()
+			vm.res = execArgs(args, files, vm.ctx)
+			closeFiles(files)
+			if res := vm.ctx.sh.dispatchSignals(vm.ctx); cmdFailed(res) {
+				vm.res = res
+			}
+		case opPipeline:
+			vm.res = execPipeline(c.pipes[in.arg], vm.ctx)
+			if res := vm.ctx.sh.dispatchSignals(vm.ctx); cmdFailed(res) {
+				vm.res = res
+			}
+		case opFuncDef:
+			closeFiles(vm.takeFiles())
+			vm.res = defineFunc(c.funcs[in.arg], vm.pop(), vm.ctx)
+		case opSave:
+			vm.saved = append(vm.saved, savedStreams{in: vm.ctx.in, out: vm.ctx.out})
+		case opRedirect:
+			s := &vm.saved[len(vm.saved)-1]
+			for _, f := range vm.takeFiles() {
+				s.files = append(s.files, f)
+			}
+			f, res := openRedirect(c.redirs[in.arg], vm.pop(), &vm.ctx)
+			if cmdFailed(res) {
+				vm.fail(res)
+				break
+			}
+			s.files = append(s.files, f)
+		case opRestore:
+			s := vm.saved[len(vm.saved)-1]
+			vm.saved = vm.saved[:len(vm.saved)-1]
+			vm.ctx.in, vm.ctx.out = s.in, s.out
+			for _, f := range s.files {
+				f.Close()
+			}
+		case opFor:
+			vals := vm.pop()
+			binds := vm.pop()
+			switch {
+			case len(binds) > 1:
+				vm.fail(errInternal{errors.New("tried to bind multiple variables in for-loop")})
+			case len(binds) == 0:
+				vm.fail(errInternal{errors.New("tried to bind variables to nothing in for-loop")})
+			default:
+				vm.loops = append(vm.loops, forLoop{
+					bind:  binds[0],
+					vals:  vals,
+					scope: vm.ctx.scope,
+					maps:  vm.ctx.maps,
+					files: vm.takeFiles(),
+				})
+			}
+		case opNext:
+			l := &vm.loops[len(vm.loops)-1]
+			if len(l.vals) == 0 {
+				vm.pc = int(in.arg)
+				break
+			}
+			if vm.ctx.scope = maps.Clone(l.scope); vm.ctx.scope == nil {
+				vm.ctx.scope = map[string][]string{}
+			}
+			vm.ctx.maps = shareMaps(l.maps)
+			vm.ctx.scope[l.bind] = []string{l.vals[0]}
+			l.vals = l.vals[1:]
+		case opDefer:
+			vm.defers = append(vm.defers, c.chunks[in.arg])
+			vm.res = errExitCode(0)
+		case opEndFor:
+			l := vm.loops[len(vm.loops)-1]
+			vm.loops = vm.loops[:len(vm.loops)-1]
+			vm.ctx.scope, vm.ctx.maps = l.scope, l.maps
+			closeFiles(l.files)
+
+		case opJump:
+			vm.pc = int(in.arg)
+		case opJumpIfFailed:
+			if cmdFailed(vm.res) {
+				vm.pc = int(in.arg)
+			}
+		case opJumpIfOK:
+			if !cmdFailed(vm.res) {
+				vm.pc = int(in.arg)
+			}
+		case opJumpIfError:
+			if _, ok := vm.res.(shellError); ok {
+				vm.pc = int(in.arg)
+			}
+		case opSucceed:
+			vm.res = errExitCode(0)
+		}
+	}
+
+	// A failing deferred command only fails the function if nothing else
+	// did first
+	ctx := vm.ctx
+	ctx.masked = true
+	for i := len(vm.defers) - 1; i >= 0; i-- {
+		if res := run(vm.defers[i], ctx); !cmdFailed(vm.res) {
+			vm.res = res
+		}
+	}
+
+	if cmdFailed(vm.res) {
+		return vm.res
+	}
+	return errExitCode(0)
+}
+
+func procSub(c *chunk, seps []string, ctx context) ([]string, commandResult) {
+	sp, err := procSubSplitter(seps)
+	if err != nil {
+		return nil, errInternal{err}
+	}
+	w := &substWriter{sp: sp, max: ctx.sh.MaxSubstOutput}
+	ctx.out = w
+	ctx.wd = ctx.wd.fork()
+	ctx.exit = ctx.exit.fork()
+
+	res := run(c, ctx)
+	if w.err != nil {
+		return nil, errInternal{w.err}
+	}
+	if cmdFailed(res) {
+		return nil, res
+	}
+	return w.sp.Fields(), nil
+}
+
+// A substWriter splits the output of a process substitution as it is
+// written.  The final newline of the output is not part of the result, so a
+// trailing newline is held back until we know that more output follows it.
+type substWriter struct {
+	sp     *stringsx.Splitter
+	nl     bool
+	n, max int64
+	err    error
+}
+
+func (w *substWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.n += int64(len(p)); w.max > 0 && w.n > w.max {
+		w.err = fmt.Errorf("output of process substitution exceeds %d bytes", w.max)
+		return 0, w.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if w.nl {
+		w.sp.Write([]byte{'\n'})
+	}
+	w.nl = p[len(p)-1] == '\n'
+	if w.nl {
+		w.sp.Write(p[:len(p)-1])
+	} else {
+		w.sp.Write(p)
+	}
+	return len(p), nil
+}
+
+// procRedir starts running c with its input or output connected to a pipe,
+// and returns the paths of the ends of the pipe for the command using it
+// along with the files it needs to pass on to the command
+func procRedir(c *chunk, kind procRedirKind, ctx context) ([]string, []*os.File, commandResult) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, errInternal{err}
+	}
+
+	xs := make([]string, 0, 2)
+	files := make([]*os.File, 0, 2)
+	if kind&procRead != 0 {
+		ctx.out = w
+		xs = append(xs, devFd(r))
+		files = append(files, r)
+	}
+	if kind&procWrite != 0 {
+		ctx.in = r
+		xs = append(xs, devFd(w))
+		files = append(files, w)
+	}
+	ctx.wd = ctx.wd.fork()
+	ctx.exit = ctx.exit.fork()
+	ctx.fg = false
+
+	go func() {
+		_ = run(c, ctx)
+		if kind&procRead != 0 {
+			w.Close()
+		}
+		if kind&procWrite != 0 {
+			r.Close()
+		}
+	}()
+
+	return xs, files, nil
+}
+
+func devFd(f *os.File) string {
+	return fmt.Sprintf("/dev/fd/%d", f.Fd())
+}
+
+func closeFiles(fs []*os.File) {
+	for _, f := range fs {
+		f.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package andy
+
+import (
+	"io"
+	"strconv"
+	"testing"
+)
+
+func benchmarkScript(b *testing.B, src string, xs []string) {
+	prog, err := Parse(src)
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+	sh := New()
+	sh.Stdout = io.Discard
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sh.SetVar("xs", xs...)
+		if err := sh.Run(prog); err != nil {
+			b.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func numbers(n int) []string {
+	xs := make([]string, n)
+	for i := range xs {
+		xs[i] = strconv.Itoa(i)
+	}
+	return xs
+}
+
+func BenchmarkWhile(b *testing.B) {
+	// Loop until we pop the final ‘false’ off of the list
+	xs := make([]string, 1001)
+	for i := range xs {
+		xs[i] = "true"
+	}
+	xs[len(xs)-1] = "false"
+	benchmarkScript(b, `while $xs[0] { set xs $xs[1..] }`, xs)
+}
+
+func BenchmarkFor(b *testing.B) {
+	benchmarkScript(b, `for x in $xs { set y $x-$x $#xs }`, numbers(1000))
+}
+
+func BenchmarkFunctionCalls(b *testing.B) {
+	src := `
+func f x {
+	set y $x
+	g $y
+}
+func g y {
+	if true { set z $y }
+}
+for x in $xs { f $x }`
+	benchmarkScript(b, src, numbers(1000))
+}
+
+func BenchmarkEcho(b *testing.B) {
+	benchmarkScript(b, `for x in $xs { echo foo $x bar$x"baz" (a b c) $#xs }`,
+		numbers(1000))
+}
+
+func TestVMControlFlow(t *testing.T) {
+	sh, out, _ := newTestInterpreter()
+	src := `
+for x in a b c {
+	if test $x = b { echo skip } else { echo $x }
+}
+set xs true true false
+while $xs[0] { echo $#xs; set xs $xs[1..] }
+{ false; echo unreachable } || echo or
+{ true && false } && echo unreachable || echo or2
+true && { false || echo and-or }
+func f a b { echo $a $b $_; { echo compound } | tr a-z A-Z }
+f 1 2 3 4
+echo (x y)$xs`
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := "a\nskip\nc\n3\n2\nor\nor2\nand-or\n1 2 3 4\nCOMPOUND\nxfalse yfalse\n"
+	if s := out.String(); s != want {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+}
+
+func TestVMErrors(t *testing.T) {
+	sh, out, errs := newTestInterpreter()
+	sh.Interactive = true
+	src := `
+echo $xs[3] foo
+{ echo $xs[3] } || echo recovered
+for x in a b { echo $x; false }
+echo after`
+	sh.SetVar("xs", "x")
+	if err := sh.RunString(src); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s := out.String(); s != "recovered\na\nafter\n" {
+		t.Fatalf("Stdout contained unexpected ‘%s’", s)
+	}
+	want := "andy: invalid index ‘3’ into list of length 1\n"
+	if s := errs.String(); s != want {
+		t.Fatalf("Stderr contained unexpected ‘%s’", s)
+	}
+}
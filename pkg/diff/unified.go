@@ -0,0 +1,159 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The number of unchanged lines shown around each change
+const context = 3
+
+type opKind byte
+
+const (
+	opKeep opKind = ' '
+	opDel  opKind = '-'
+	opAdd  opKind = '+'
+)
+
+type op struct {
+	kind opKind
+	line string
+}
+
+// Unified returns a unified diff of the lines of a and b, with aName and bName
+// as the names of the old and new files.  If a and b are equal the empty
+// string is returned.
+func Unified(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	ops := lineDiff(splitLines(a), splitLines(b))
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+
+	// i and j are the current lines in a and b
+	for i, j, k := 0, 0, 0; k < len(ops); {
+		if ops[k].kind == opKeep {
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+
+		// Extend the hunk until we find more than 2*context unchanged
+		// lines in a row, or hit the end
+		start := max(k-context, 0)
+		end := k
+		for n := 0; end < len(ops) && n <= 2*context; end++ {
+			if ops[end].kind == opKeep {
+				n++
+			} else {
+				n = 0
+			}
+		}
+		for end > k && ops[end-1].kind == opKeep && keptSince(ops, end) > context {
+			end--
+		}
+
+		ai, bi := i-(k-start), j-(k-start)
+		var an, bn int
+		for _, o := range ops[start:end] {
+			if o.kind != opAdd {
+				an++
+			}
+			if o.kind != opDel {
+				bn++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ai, an), hunkRange(bi, bn))
+		for _, o := range ops[start:end] {
+			sb.WriteByte(byte(o.kind))
+			sb.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, o := range ops[k:end] {
+			if o.kind != opAdd {
+				i++
+			}
+			if o.kind != opDel {
+				j++
+			}
+		}
+		k = end
+	}
+
+	return sb.String()
+}
+
+// keptSince returns the number of unchanged lines directly before ops[end]
+func keptSince(ops []op, end int) int {
+	n := 0
+	for end--; end >= 0 && ops[end].kind == opKeep; end-- {
+		n++
+	}
+	return n
+}
+
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits s into lines, keeping the newlines
+func splitLines(s string) []string {
+	xs := strings.SplitAfter(s, "\n")
+	if xs[len(xs)-1] == "" {
+		xs = xs[:len(xs)-1]
+	}
+	return xs
+}
+
+// lineDiff returns the edits turning a into b, based on the longest common
+// subsequence of their lines
+func lineDiff(a, b []string) []op {
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]op, 0, max(len(a), len(b)))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{opKeep, a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, op{opDel, a[i]})
+			i++
+		default:
+			ops = append(ops, op{opAdd, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{opDel, a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{opAdd, b[j]})
+	}
+	return ops
+}
@@ -0,0 +1,35 @@
+package diff
+
+import "testing"
+
+func assertDiff(t *testing.T, a, b, want string) {
+	if s := Unified("a", "b", a, b); s != want {
+		t.Fatalf("Expected diff ‘%s’ but got ‘%s’", want, s)
+	}
+}
+
+func TestUnifiedEqual(t *testing.T) {
+	assertDiff(t, "foo\nbar\n", "foo\nbar\n", "")
+}
+
+func TestUnifiedSimple(t *testing.T) {
+	assertDiff(t, "foo\nbar\nbaz\n", "foo\nqux\nbaz\n",
+		"--- a\n+++ b\n@@ -1,3 +1,3 @@\n foo\n-bar\n+qux\n baz\n")
+	assertDiff(t, "", "foo\n", "--- a\n+++ b\n@@ -0,0 +1 @@\n+foo\n")
+	assertDiff(t, "foo", "foo\n",
+		"--- a\n+++ b\n@@ -1 +1 @@\n-foo\n\\ No newline at end of file\n+foo\n")
+}
+
+func TestUnifiedHunks(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"
+	assertDiff(t, a, b, "--- a\n+++ b\n"+
+		"@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n"+
+		"@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n")
+
+	// Changes close to each other share a hunk
+	a = "1\n2\n3\n4\n5\n6\n7\n8\n"
+	b = "1\nx\n3\n4\n5\n6\n7\ny\n"
+	assertDiff(t, a, b, "--- a\n+++ b\n"+
+		"@@ -1,8 +1,8 @@\n 1\n-2\n+x\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n")
+}
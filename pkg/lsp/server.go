@@ -0,0 +1,375 @@
+// Package lsp implements a language server for the Andy shell language,
+// speaking the Language Server Protocol over a pair of streams
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~mango/andy/pkg/andy"
+)
+
+// Variables set by the shell itself, offered as completions
+var shellVars = []string{"_", "args", "cdstack", "pid", "ppid", "status"}
+
+var keywords = []string{"defer", "else", "for", "func", "if", "in", "while"}
+
+// A server is a language server handling a single client
+type server struct {
+	r *textproto.Reader
+	w *bufio.Writer
+
+	docs     map[string]document
+	builtins map[string]*andy.Builtin
+	shutdown bool
+}
+
+// errExit is returned by handlers to stop the server
+var errExit = errors.New("exit")
+
+// Serve runs a language server reading requests from r and writing responses
+// to w until the client asks it to exit
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{
+		r:        textproto.NewReader(bufio.NewReader(r)),
+		w:        bufio.NewWriter(w),
+		docs:     make(map[string]document),
+		builtins: make(map[string]*andy.Builtin),
+	}
+	for _, b := range andy.New().Builtins() {
+		s.builtins[b.Name] = b
+	}
+
+	for {
+		req, err := s.read()
+		var rerr *responseError
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.As(err, &rerr):
+			if err := s.respond(json.RawMessage("null"), nil, err); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		res, err := s.handle(req)
+		if errors.Is(err, errExit) {
+			if !s.shutdown {
+				return errors.New("exit requested without a shutdown")
+			}
+			return nil
+		}
+		if req.ID == nil {
+			continue // Notifications get no response
+		}
+		if err := s.respond(req.ID, res, err); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) read() (request, error) {
+	var req request
+	hdr, err := s.r.ReadMIMEHeader()
+	if err != nil {
+		return req, err
+	}
+	n, err := strconv.Atoi(hdr.Get("Content-Length"))
+	if err != nil {
+		return req, fmt.Errorf("invalid Content-Length: %w", err)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.r.R, body); err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, &responseError{codeParseError, err.Error()}
+	}
+	return req, nil
+}
+
+func (s *server) write(msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n", len(body))
+	s.w.Write(body)
+	return s.w.Flush()
+}
+
+func (s *server) respond(id json.RawMessage, res any, err error) error {
+	msg := map[string]any{"jsonrpc": "2.0", "id": id}
+	var rerr *responseError
+	switch {
+	case errors.As(err, &rerr):
+		msg["error"] = rerr
+	case err != nil:
+		msg["error"] = responseError{codeInvalidRequest, err.Error()}
+	default:
+		msg["result"] = res
+	}
+	return s.write(msg)
+}
+
+func (s *server) notify(method string, params any) error {
+	return s.write(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+func (s *server) handle(req request) (any, error) {
+	if s.shutdown && req.Method != "exit" {
+		return nil, &responseError{codeInvalidRequest, "server is shut down"}
+	}
+
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // Full
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]any{"triggerCharacters": []string{"$"}},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "andy"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "exit":
+		return nil, errExit
+
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if err := unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p didChangeParams
+		if err := unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			return nil, s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p didCloseParams
+		if err := unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics",
+			publishDiagnosticsParams{p.TextDocument.URI, []diagnostic{}})
+
+	case "textDocument/definition":
+		return withPosition(s, req, s.definition)
+	case "textDocument/hover":
+		return withPosition(s, req, s.hover)
+	case "textDocument/completion":
+		return withPosition(s, req, s.completion)
+	case "textDocument/documentSymbol":
+		var p documentSymbolParams
+		if err := unmarshal(req.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.documentSymbols(p.TextDocument.URI), nil
+	}
+
+	if req.ID == nil || strings.HasPrefix(req.Method, "$/") {
+		return nil, nil
+	}
+	return nil, &responseError{codeMethodNotFound,
+		fmt.Sprintf("unsupported method ‘%s’", req.Method)}
+}
+
+func unmarshal(params json.RawMessage, v any) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &responseError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func withPosition[T any](s *server, req request,
+	f func(uri string, d document, line, col int) T) (any, error) {
+	var p textDocumentPositionParams
+	if err := unmarshal(req.Params, &p); err != nil {
+		return nil, err
+	}
+	d, ok := s.docs[p.TextDocument.URI]
+	if !ok {
+		return nil, &responseError{codeInvalidParams,
+			fmt.Sprintf("unknown document ‘%s’", p.TextDocument.URI)}
+	}
+	line, col := d.fromLSP(p.Position)
+	return f(p.TextDocument.URI, d, line, col), nil
+}
+
+// update stores the new text of a document and publishes its diagnostics
+func (s *server) update(uri, text string) error {
+	d := newDocument(text)
+	s.docs[uri] = d
+
+	diags := []diagnostic{}
+	for _, x := range andy.Lint(uri, text) {
+		diags = append(diags, diagnostic{
+			Range:    d.wordRange(x.Line, x.Col),
+			Severity: severityWarning,
+			Source:   "andy",
+			Message:  x.Message,
+		})
+	}
+	return s.notify("textDocument/publishDiagnostics",
+		publishDiagnosticsParams{uri, diags})
+}
+
+func (s *server) definition(uri string, d document, line, col int) *location {
+	o, err := andy.Symbols(uri, d.text)
+	if err != nil {
+		return nil
+	}
+	sym, ok := o.At(line, col)
+	if !ok {
+		return nil
+	}
+	def, ok := o.Definition(sym)
+	if !ok {
+		return nil
+	}
+	return &location{uri, d.nameRange(def.Line, def.Col, def.Name)}
+}
+
+func (s *server) hover(uri string, d document, line, col int) *hover {
+	o, err := andy.Symbols(uri, d.text)
+	if err != nil {
+		return nil
+	}
+	sym, ok := o.At(line, col)
+	if !ok {
+		return nil
+	}
+
+	var sb strings.Builder
+	def, defined := o.Definition(sym)
+	switch {
+	case sym.Kind == andy.FuncSymbol && defined:
+		fmt.Fprintf(&sb, "```andy\nfunc %s\n```\n\nDefined on line %d",
+			strings.Join(append([]string{def.Name}, def.Args...), " "),
+			def.Line)
+	case sym.Kind == andy.FuncSymbol && s.builtins[sym.Name] != nil:
+		sb.WriteString("```\n")
+		for _, u := range s.builtins[sym.Name].Usage {
+			sb.WriteString(u + "\n")
+		}
+		sb.WriteString("```\n\nBuiltin")
+	case sym.Kind == andy.VarSymbol && slices.Contains(shellVars, sym.Name):
+		fmt.Fprintf(&sb, "Variable ‘%s’, set by the shell", sym.Name)
+	case sym.Kind == andy.VarSymbol && defined:
+		fmt.Fprintf(&sb, "Variable ‘%s’, set on line %d", sym.Name, def.Line)
+	default:
+		return nil
+	}
+
+	return &hover{
+		Contents: markupContent{"markdown", sb.String()},
+		Range:    d.nameRange(sym.Line, sym.Col, sym.Name),
+	}
+}
+
+func (s *server) completion(uri string, d document, line, col int) []completionItem {
+	// Complete variables after a ‘$’, and commands otherwise
+	text := d.line(line - 1)
+	prefix := strings.TrimRightFunc(text[:min(col-1, len(text))], isNameRune)
+	prefix = strings.TrimRight(prefix, "^#(")
+	isVar := strings.HasSuffix(prefix, "$")
+
+	// The document may be half-written, in which case we only offer what
+	// doesn’t depend on parsing it
+	o, _ := andy.Symbols(uri, d.text)
+	items := []completionItem{}
+	seen := make(map[string]bool)
+	add := func(name string, kind int, detail string) {
+		if !seen[name] {
+			seen[name] = true
+			items = append(items, completionItem{name, kind, detail})
+		}
+	}
+
+	if isVar {
+		for _, v := range shellVars {
+			add(v, completionVariable, "shell variable")
+		}
+		for _, def := range o.Defs {
+			if def.Kind == andy.VarSymbol {
+				add(def.Name, completionVariable, "variable")
+			}
+		}
+		return items
+	}
+
+	for _, def := range o.Defs {
+		if def.Kind == andy.FuncSymbol {
+			add(def.Name, completionFunction, "function")
+		}
+	}
+	for _, b := range s.builtins {
+		add(b.Name, completionFunction, "builtin")
+	}
+	for _, k := range keywords {
+		add(k, completionKeyword, "")
+	}
+	slices.SortStableFunc(items, func(a, b completionItem) int {
+		return strings.Compare(a.Label, b.Label)
+	})
+	return items
+}
+
+func (s *server) documentSymbols(uri string) []documentSymbol {
+	xs := []documentSymbol{}
+	d, ok := s.docs[uri]
+	if !ok {
+		return xs
+	}
+	o, err := andy.Symbols(uri, d.text)
+	if err != nil {
+		return xs
+	}
+
+	for _, def := range o.Defs {
+		if def.Kind != andy.FuncSymbol {
+			continue
+		}
+		xs = append(xs, documentSymbol{
+			Name:   def.Name,
+			Detail: strings.Join(def.Args, " "),
+			Kind:   symbolFunction,
+			Range: rng{
+				Start: d.toLSP(def.Line, 1),
+				End:   d.toLSP(def.EndLine, def.EndCol+1),
+			},
+			SelectionRange: d.nameRange(def.Line, def.Col, def.Name),
+		})
+	}
+	return xs
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || r == '-' || r >= '0' && r <= '9' ||
+		r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 0x7F
+}
@@ -0,0 +1,141 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const script = `func greet name {
+	echo "Hello $name"
+}
+set who world
+greet $who
+echo $nope`
+
+func frame(msgs ...string) string {
+	var sb strings.Builder
+	for _, m := range msgs {
+		fmt.Fprintf(&sb, "Content-Length: %d\r\n\r\n%s", len(m), m)
+	}
+	return sb.String()
+}
+
+func message(id int, method string, params any) string {
+	p, _ := json.Marshal(params)
+	if id == 0 {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":%s}`, method, p)
+	}
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":%q,"params":%s}`,
+		id, method, p)
+}
+
+func at(line, char int) map[string]any {
+	return map[string]any{
+		"textDocument": map[string]string{"uri": "file:///x.an"},
+		"position":     map[string]int{"line": line, "character": char},
+	}
+}
+
+// runServer sends the requests to a server and returns its responses by ID,
+// and its notifications by method
+func runServer(t *testing.T, reqs ...string) map[string]json.RawMessage {
+	r, w := io.Pipe()
+	errc := make(chan error)
+	go func() {
+		err := Serve(strings.NewReader(frame(reqs...)), w)
+		w.Close()
+		errc <- err
+	}()
+
+	msgs := make(map[string]json.RawMessage)
+	tr := textproto.NewReader(bufio.NewReader(r))
+	for {
+		hdr, err := tr.ReadMIMEHeader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read header: %s", err)
+		}
+		n, _ := strconv.Atoi(hdr.Get("Content-Length"))
+		body := make([]byte, n)
+		io.ReadFull(tr.R, body)
+
+		var msg struct {
+			ID     *int
+			Method string
+			Result json.RawMessage
+			Params json.RawMessage
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("Invalid response ‘%s’: %s", body, err)
+		}
+		if msg.ID != nil {
+			msgs[strconv.Itoa(*msg.ID)] = msg.Result
+		} else {
+			msgs[msg.Method] = msg.Params
+		}
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return msgs
+}
+
+func assertJSON(t *testing.T, got json.RawMessage, want string) {
+	if string(got) != want {
+		t.Fatalf("Expected ‘%s’ but got ‘%s’", want, got)
+	}
+}
+
+func TestServer(t *testing.T) {
+	open := map[string]any{"textDocument": map[string]string{
+		"uri":  "file:///x.an",
+		"text": script,
+	}}
+	msgs := runServer(t,
+		message(1, "initialize", map[string]any{}),
+		message(0, "initialized", map[string]any{}),
+		message(0, "textDocument/didOpen", open),
+		message(2, "textDocument/definition", at(4, 1)),
+		message(3, "textDocument/definition", at(4, 8)),
+		message(4, "textDocument/definition", at(1, 15)),
+		message(5, "textDocument/hover", at(3, 1)),
+		message(6, "textDocument/documentSymbol", map[string]any{
+			"textDocument": map[string]string{"uri": "file:///x.an"},
+		}),
+		message(7, "textDocument/completion", at(5, 7)),
+		message(8, "shutdown", nil),
+		message(0, "exit", nil),
+	)
+
+	assertJSON(t, msgs["textDocument/publishDiagnostics"],
+		`{"uri":"file:///x.an","diagnostics":[{"range":{"start":{"line":5,"character":5},"end":{"line":5,"character":10}},"severity":2,"source":"andy","message":"the variable ‘nope’ is never set"}]}`)
+	assertJSON(t, msgs["2"],
+		`{"uri":"file:///x.an","range":{"start":{"line":0,"character":5},"end":{"line":0,"character":10}}}`)
+	assertJSON(t, msgs["3"],
+		`{"uri":"file:///x.an","range":{"start":{"line":3,"character":4},"end":{"line":3,"character":7}}}`)
+	assertJSON(t, msgs["4"],
+		`{"uri":"file:///x.an","range":{"start":{"line":0,"character":11},"end":{"line":0,"character":15}}}`)
+	assertJSON(t, msgs["5"],
+		`{"contents":{"kind":"markdown","value":"`+"```"+`\nset [-g] variable [value ...]\nset -a|-p [-g] variable value ...\nset -e variable [value]\n`+"```"+`\n\nBuiltin"},"range":{"start":{"line":3,"character":0},"end":{"line":3,"character":3}}}`)
+	assertJSON(t, msgs["6"],
+		`[{"name":"greet","detail":"name","kind":12,"range":{"start":{"line":0,"character":0},"end":{"line":2,"character":1}},"selectionRange":{"start":{"line":0,"character":5},"end":{"line":0,"character":10}}}]`)
+	assertJSON(t, msgs["8"], "null")
+
+	var items []completionItem
+	json.Unmarshal(msgs["7"], &items)
+	var labels []string
+	for _, it := range items {
+		labels = append(labels, it.Label)
+	}
+	if s := strings.Join(labels, " "); s != "_ args cdstack pid ppid status name who" {
+		t.Fatalf("Unexpected completions ‘%s’", s)
+	}
+}
@@ -0,0 +1,81 @@
+package lsp
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A document is the text of an open file.  Positions in the protocol are
+// counted in UTF-16 code units while the Andy parser counts in bytes, so we
+// need the lines of the text to convert between them.
+type document struct {
+	text  string
+	lines []string
+}
+
+func newDocument(text string) document {
+	return document{text, strings.Split(text, "\n")}
+}
+
+func (d document) line(n int) string {
+	if n < 0 || n >= len(d.lines) {
+		return ""
+	}
+	return d.lines[n]
+}
+
+// toLSP converts a 1-based line and byte column into a protocol position
+func (d document) toLSP(line, col int) position {
+	s := d.line(line - 1)
+	col = min(max(col-1, 0), len(s))
+	n := 0
+	for _, r := range s[:col] {
+		n += utf16Len(r)
+	}
+	return position{Line: line - 1, Character: n}
+}
+
+// fromLSP converts a protocol position into a 1-based line and byte column
+func (d document) fromLSP(p position) (int, int) {
+	s := d.line(p.Line)
+	n := 0
+	for i, r := range s {
+		if n >= p.Character {
+			return p.Line + 1, i + 1
+		}
+		n += utf16Len(r)
+	}
+	return p.Line + 1, len(s) + 1
+}
+
+// wordRange returns the range of the non-whitespace text starting at the
+// 1-based line and byte column, which is at least a single character long
+func (d document) wordRange(line, col int) rng {
+	s := d.line(line - 1)
+	end := max(col-1, 0)
+	for end < len(s) {
+		r, n := utf8.DecodeRuneInString(s[end:])
+		if unicode.IsSpace(r) {
+			break
+		}
+		end += n
+	}
+	if end == col-1 && end < len(s) {
+		end++
+	}
+	return rng{d.toLSP(line, col), d.toLSP(line, end+1)}
+}
+
+// nameRange returns the range of name starting at the 1-based line and byte
+// column
+func (d document) nameRange(line, col int, name string) rng {
+	return rng{d.toLSP(line, col), d.toLSP(line, col+len(name))}
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -1,25 +1,10 @@
 package stringsx
 
-import "strings"
-
+// SplitMulti splits s on any of the separators in seps.  When more than one
+// separator matches at the same position, the longest one wins.  A trailing
+// empty field is dropped.
 func SplitMulti(s string, seps []string) []string {
-	out := make([]string, 0, 8)
-
-	var i int
-	for j := 0; j < len(s); j++ {
-		for _, sep := range seps {
-			if !strings.HasPrefix(s[j:], sep) {
-				continue
-			}
-			out = append(out, s[i:j])
-			j += len(sep) - 1
-			i = j + 1
-			break
-		}
-	}
-	if i < len(s) {
-		out = append(out, s[i:])
-	}
-
-	return out
+	sp := NewSplitter(seps)
+	sp.Write([]byte(s))
+	return sp.Fields()
 }
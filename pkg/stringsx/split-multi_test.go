@@ -79,8 +79,8 @@ func TestSplitOverlapping2(t *testing.T) {
 	if ys[0] != "foo" {
 		t.Fatalf("Expected ys[0] == \"foo\" but got ‘%s’\n", ys[0])
 	}
-	if xs[1] != ":bar" {
-		t.Fatalf("Expected xs[1] == \":bar\" but got ‘%s’\n", xs[1])
+	if xs[1] != "bar" {
+		t.Fatalf("Expected xs[1] == \"bar\" but got ‘%s’\n", xs[1])
 	}
 	if ys[1] != "bar" {
 		t.Fatalf("Expected ys[1] == \"bar\" but got ‘%s’\n", ys[1])
@@ -0,0 +1,163 @@
+package stringsx
+
+import (
+	"regexp"
+	"strings"
+)
+
+// EmptyFields controls which empty fields a Splitter returns
+type EmptyFields int
+
+const (
+	// Keep empty fields, except for a trailing one.  This is what you want
+	// when splitting text that usually ends in a separator, such as lines.
+	KeepInner EmptyFields = iota
+
+	KeepEmpty
+	DropEmpty
+)
+
+// A Splitter splits the text written to it on any of a set of separators
+// without needing all of the text up front.  When more than one separator
+// matches at the same position, the longest one wins.  Only the bytes of the
+// current field are kept in memory, so it can split text of any size.
+// Splitters created by NewRegexpSplitter are the exception, as regular
+// expressions can match text of any length.
+type Splitter struct {
+	// Empty controls which empty fields are returned
+	Empty EmptyFields
+
+	seps   []string
+	maxLen int
+	re     *regexp.Regexp
+
+	buf    []byte // The text of the current field and anything after it
+	j      int    // Offset into buf of the next byte to match against
+	n      int    // Number of bytes written
+	fields []string
+}
+
+// NewSplitter returns a Splitter splitting on seps.  Empty separators are
+// ignored.
+func NewSplitter(seps []string) *Splitter {
+	s := &Splitter{seps: make([]string, 0, len(seps))}
+	for _, sep := range seps {
+		if sep != "" {
+			s.seps = append(s.seps, sep)
+			s.maxLen = max(s.maxLen, len(sep))
+		}
+	}
+	return s
+}
+
+// NewRegexpSplitter returns a Splitter splitting on matches of any of the
+// regular expressions in exprs.  Empty matches are ignored.
+func NewRegexpSplitter(exprs []string) (*Splitter, error) {
+	if len(exprs) == 0 {
+		return NewSplitter(nil), nil
+	}
+
+	xs := make([]string, len(exprs))
+	for i, e := range exprs {
+		// Compile each expression on its own first so that errors refer
+		// to the expression as written
+		if _, err := regexp.Compile(e); err != nil {
+			return nil, err
+		}
+		xs[i] = "(?:" + e + ")"
+	}
+	re := regexp.MustCompile(strings.Join(xs, "|"))
+	re.Longest()
+	return &Splitter{re: re}, nil
+}
+
+// Write adds p to the text being split.  It never returns an error.
+func (s *Splitter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	s.n += len(p)
+
+	// We can’t commit to a match until we can see enough bytes to match
+	// any of the separators
+	if s.re == nil {
+		s.split(len(s.buf) - s.maxLen)
+	}
+	return len(p), nil
+}
+
+// Fields returns the fields of all of the text written so far.  Writing to
+// the Splitter after calling Fields is not allowed.
+func (s *Splitter) Fields() []string {
+	if s.re != nil {
+		s.splitRegexp()
+	} else {
+		s.split(len(s.buf) - 1)
+	}
+
+	// If the buffer is empty but text was written, the text ended with a
+	// separator
+	if len(s.buf) > 0 || s.n > 0 && s.Empty == KeepEmpty {
+		s.emit(s.buf)
+		s.buf = s.buf[:0]
+	}
+	return s.fields
+}
+
+// Reset discards all of the text written to the Splitter, allowing it to be
+// reused
+func (s *Splitter) Reset() {
+	s.buf = s.buf[:0]
+	s.j, s.n = 0, 0
+	s.fields = nil
+}
+
+func (s *Splitter) emit(field []byte) {
+	if len(field) > 0 || s.Empty != DropEmpty {
+		s.fields = append(s.fields, string(field))
+	}
+}
+
+// split splits the buffered text on separators starting at or before the
+// offset end
+func (s *Splitter) split(end int) {
+	if len(s.seps) == 0 {
+		return
+	}
+
+	i := 0
+	for ; s.j <= end; s.j++ {
+		n := 0
+		for _, sep := range s.seps {
+			if len(sep) > n && hasPrefix(s.buf[s.j:], sep) {
+				n = len(sep)
+			}
+		}
+		if n > 0 {
+			s.emit(s.buf[i:s.j])
+			i = s.j + n
+			s.j = i - 1
+		}
+	}
+
+	if i > 0 {
+		n := copy(s.buf, s.buf[i:])
+		s.buf = s.buf[:n]
+		s.j -= i
+	}
+}
+
+func (s *Splitter) splitRegexp() {
+	i := 0
+	for _, m := range s.re.FindAllIndex(s.buf, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		s.emit(s.buf[i:m[0]])
+		i = m[1]
+	}
+	n := copy(s.buf, s.buf[i:])
+	s.buf = s.buf[:n]
+}
+
+func hasPrefix(b []byte, s string) bool {
+	return len(b) >= len(s) && string(b[:len(s)]) == s
+}
@@ -0,0 +1,106 @@
+package stringsx
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// splitReference splits s without any of the buffering of a Splitter
+func splitReference(s string, seps []string) []string {
+	out := []string{}
+
+	var i int
+	for j := 0; j < len(s); j++ {
+		n := 0
+		for _, sep := range seps {
+			if strings.HasPrefix(s[j:], sep) {
+				n = max(n, len(sep))
+			}
+		}
+		if n > 0 {
+			out = append(out, s[i:j])
+			j += n - 1
+			i = j + 1
+		}
+	}
+	if i < len(s) {
+		out = append(out, s[i:])
+	}
+
+	return out
+}
+
+func TestSplitterStreaming(t *testing.T) {
+	tests := []struct {
+		s    string
+		seps []string
+	}{
+		{"foo::bar::baz", []string{"::"}},
+		{"foo:::bar", []string{"::", ":::"}},
+		{"foo:::bar", []string{":::", "::"}},
+		{"a\nb\n\nc\n", []string{"\n"}},
+		{"a, b,c ,, d", []string{", ", ",", " "}},
+		{"xxabxxabcxx", []string{"abc", "ab"}},
+		{"no separators here", []string{"::"}},
+		{"trailing::", []string{"::"}},
+		{"", []string{"::"}},
+		{"foo bar", nil},
+	}
+
+	for _, tt := range tests {
+		want := splitReference(tt.s, tt.seps)
+		for n := 1; n <= max(len(tt.s), 1); n++ {
+			sp := NewSplitter(tt.seps)
+			for i := 0; i < len(tt.s); i += n {
+				sp.Write([]byte(tt.s[i:min(i+n, len(tt.s))]))
+			}
+			if got := sp.Fields(); !slices.Equal(got, want) {
+				t.Fatalf("Splitting %q on %q in chunks of %d gave %q but expected %q",
+					tt.s, tt.seps, n, got, want)
+			}
+		}
+	}
+}
+
+func TestSplitterEmptySeparator(t *testing.T) {
+	xs := SplitMulti("a:b", []string{"", ":"})
+	if !slices.Equal(xs, []string{"a", "b"}) {
+		t.Fatalf("Expected [a b] but got %q", xs)
+	}
+}
+
+func TestSplitterEmptyFields(t *testing.T) {
+	tests := []struct {
+		empty EmptyFields
+		want  []string
+	}{
+		{KeepInner, []string{"", "a", "", "b"}},
+		{KeepEmpty, []string{"", "a", "", "b", ""}},
+		{DropEmpty, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		sp := NewSplitter([]string{","})
+		sp.Empty = tt.empty
+		sp.Write([]byte(",a,,b,"))
+		if got := sp.Fields(); !slices.Equal(got, tt.want) {
+			t.Fatalf("Expected %q with mode %d but got %q", tt.want, tt.empty, got)
+		}
+	}
+}
+
+func TestSplitterRegexp(t *testing.T) {
+	sp, err := NewRegexpSplitter([]string{`\s+`, `,`, `x*`})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sp.Write([]byte("a  b,"))
+	sp.Write([]byte("\tcxxd"))
+	if xs := sp.Fields(); !slices.Equal(xs, []string{"a", "b", "", "c", "d"}) {
+		t.Fatalf("Got unexpected fields %q", xs)
+	}
+
+	if _, err := NewRegexpSplitter([]string{"(", "a"}); err == nil {
+		t.Fatalf("Expected an invalid regular expression to fail")
+	}
+}